@@ -19,6 +19,26 @@ type Logger struct {
 	Port     int    `config:"logger_port"`
 	Level    string `config:"logger_level"`
 	CLILevel string `config:"cli_level"`
+
+	AccessLog bool `config:"logger_access_log"`
+
+	// transport to graylog: udp, tcp or tls
+	Transport             string `config:"logger_transport"`
+	TLSCAPath             string `config:"logger_tls_ca_path"`
+	TLSInsecureSkipVerify bool   `config:"logger_tls_insecure_skip_verify"`
+	// messages buffered while graylog is unreachable with tcp and tls, and policy once full:
+	// drop_oldest or drop_newest
+	BufferSize int    `config:"logger_buffer_size"`
+	DropPolicy string `config:"logger_drop_policy"`
+	// delays between the reconnections, doubled after each failure, in milliseconds
+	BackoffMin int `config:"logger_backoff_min_ms"`
+	BackoffMax int `config:"logger_backoff_max_ms"`
+	// messages waiting to be sent in the background, sent by batches at least every flush
+	// interval, and maximum wait for them at shutdown, in milliseconds
+	AsyncRingSize      int `config:"logger_async_ring_size"`
+	AsyncBatchSize     int `config:"logger_async_batch_size"`
+	AsyncFlushInterval int `config:"logger_async_flush_interval_ms"`
+	SyncTimeout        int `config:"logger_sync_timeout_ms"`
 }
 
 type Swagger struct {
@@ -29,8 +49,18 @@ type Swagger struct {
 }
 
 type Metrics struct {
-	Port int    `config:"metrics_port"`
-	Host string `config:"metrics_host"`
+	Port       int    `config:"metrics_port"`
+	Host       string `config:"metrics_host"`
+	ParamsTopK int    `config:"metrics_params_top_k"`
+
+	StatsDActive        bool     `config:"metrics_statsd_active"`
+	StatsDAddr          string   `config:"metrics_statsd_addr"`
+	StatsDPrefix        string   `config:"metrics_statsd_prefix"`
+	StatsDFlavor        string   `config:"metrics_statsd_flavor"`
+	StatsDTags          []string `config:"metrics_statsd_tags"`
+	StatsDSampleRate    float64  `config:"metrics_statsd_sample_rate"`
+	StatsDMaxPacketSize int      `config:"metrics_statsd_max_packet_size"`
+	StatsDFlushInterval int      `config:"metrics_statsd_flush_interval_ms"`
 }
 
 type Parameters struct {
@@ -39,18 +69,116 @@ type Parameters struct {
 	MaxNb      int `config:"max_nb_limit"`
 }
 
+type Peers struct {
+	Self    string   `config:"peers_self"`
+	Addrs   []string `config:"peers_addrs"`
+	Secret  string   `config:"peers_secret,obfuscate"`
+	Timeout int      `config:"peers_timeout_ms"`
+	Retry   int      `config:"peers_retry"`
+}
+
+type Compression struct {
+	Active    bool     `config:"compression_active"`
+	MinSize   int      `config:"compression_min_size"`
+	Encodings []string `config:"compression_encodings"`
+}
+
+type RateLimit struct {
+	Active         bool    `config:"rate_limit_active"`
+	Rate           float64 `config:"rate_limit_rate"`
+	Burst          int     `config:"rate_limit_burst"`
+	Buckets        int     `config:"rate_limit_buckets"`
+	TrustedProxies int     `config:"rate_limit_trusted_proxies"`
+}
+
+type Auth struct {
+	KeysPath       string `config:"auth_keys_path"`
+	Header         string `config:"auth_header"`
+	AllowAnonymous bool   `config:"auth_allow_anonymous"`
+}
+
+type Admission struct {
+	Active       bool `config:"admission_active"`
+	Budget       int  `config:"admission_budget"`
+	QueueTimeout int  `config:"admission_queue_timeout_ms"`
+}
+
+type CORS struct {
+	Active         bool     `config:"cors_active"`
+	Origins        []string `config:"cors_allowed_origins"`
+	Methods        []string `config:"cors_allowed_methods"`
+	Headers        []string `config:"cors_allowed_headers"`
+	ExposedHeaders []string `config:"cors_exposed_headers"`
+	Credentials    bool     `config:"cors_allow_credentials"`
+	MaxAge         int      `config:"cors_max_age"`
+}
+
+type Security struct {
+	HSTSMaxAge int `config:"security_hsts_max_age"`
+}
+
+type Usage struct {
+	Active        bool   `config:"usage_active"`
+	StorePath     string `config:"usage_store_path"`
+	FlushInterval int    `config:"usage_flush_interval"`
+}
+
+type JWT struct {
+	JWKSPath       string `config:"jwt_jwks_path"`
+	Issuer         string `config:"jwt_issuer"`
+	Audience       string `config:"jwt_audience"`
+	ClockSkew      int    `config:"jwt_clock_skew"`
+	ReloadInterval int    `config:"jwt_reload_interval"`
+	APIScope       string `config:"jwt_api_scope"`
+	AdminScope     string `config:"jwt_admin_scope"`
+	PProfScope     string `config:"jwt_pprof_scope"`
+}
+
+type Tracing struct {
+	Active        bool    `config:"tracing_active"`
+	Endpoint      string  `config:"tracing_endpoint"`
+	SampleRatio   float64 `config:"tracing_sample_ratio"`
+	BatchSize     int     `config:"tracing_batch_size"`
+	FlushInterval int     `config:"tracing_flush_interval_ms"`
+	Timeout       int     `config:"tracing_timeout_ms"`
+}
+
 type Healthz struct {
 	ReadTimeout  time.Duration `config:"healthz_read_timeout"`
 	WriteTimeout time.Duration `config:"healthz_write_timeout"`
 }
 
 type Cache struct {
-	Size            int  `config:"cache_size"`
-	TTL             int  `config:"cache_ttl"`
-	MaxSizeAccepted int  `config:"cache_max_sized_accepted"`
-	NegSize         int  `config:"cache_neg_size"`
-	NegTTL          int  `config:"cache_neg_tll"`
-	Active          bool `config:"cache_active"`
+	Size             int    `config:"cache_size"`
+	TTL              int    `config:"cache_ttl"`
+	MaxSizeAccepted  int    `config:"cache_max_sized_accepted"`
+	NegSize          int    `config:"cache_neg_size"`
+	NegTTL           int    `config:"cache_neg_tll"`
+	Active           bool   `config:"cache_active"`
+	SnapshotPath     string `config:"cache_snapshot_path"`
+	SnapshotInterval int    `config:"cache_snapshot_interval"`
+	MaxFetchers      int    `config:"cache_max_fetchers"`
+
+	TTLJitter        float64 `config:"cache_ttl_jitter"`
+	EarlyRefreshBeta float64 `config:"cache_early_refresh_beta"`
+
+	WarmTopN        int      `config:"cache_warm_top_n"`
+	WarmSets        []string `config:"cache_warm_sets"`
+	WarmInterval    int      `config:"cache_warm_interval"`
+	WarmConcurrency int      `config:"cache_warm_concurrency"`
+	StatsSize       int      `config:"cache_stats_size"`
+
+	L2Backend  string `config:"cache_l2_backend"`
+	L2Path     string `config:"cache_l2_path"`
+	L2Addr     string `config:"cache_l2_addr"`
+	L2Timeout  int    `config:"cache_l2_timeout_ms"`
+	L2PoolSize int    `config:"cache_l2_pool_size"`
+	L2Sweep    int    `config:"cache_l2_sweep_interval"`
+
+	Compressed bool `config:"cache_compressed"`
+
+	HTTPMaxAge               int `config:"cache_http_max_age"`
+	HTTPStaleWhileRevalidate int `config:"cache_http_stale_while_revalidate"`
 }
 
 type Config struct {
@@ -75,6 +203,26 @@ type Config struct {
 	Swagger
 
 	Cache
+
+	Peers
+
+	Compression
+
+	RateLimit
+
+	Admission
+
+	Auth
+
+	JWT
+
+	Usage
+
+	CORS
+
+	Security
+
+	Tracing
 }
 
 func getDefaultConfig() *Config {
@@ -111,20 +259,119 @@ func getDefaultConfig() *Config {
 			Host:     "127.0.0.1",
 			Port:     12201,
 			Level:    "INFO",
+
+			AccessLog: true,
+
+			Transport:  "udp",
+			BufferSize: 1000,
+			DropPolicy: "drop_oldest",
+			BackoffMin: 100,
+			BackoffMax: 30000,
+
+			AsyncRingSize:      10000,
+			AsyncBatchSize:     100,
+			AsyncFlushInterval: 200,
+			SyncTimeout:        2000,
 		},
 
 		Metrics: Metrics{
-			Port: 8081,
-			Host: "127.0.0.1",
+			Port:       8081,
+			Host:       "127.0.0.1",
+			ParamsTopK: 20,
+
+			StatsDAddr:          "127.0.0.1:8125",
+			StatsDPrefix:        "fizzbuzz_api.",
+			StatsDFlavor:        "dogstatsd",
+			StatsDSampleRate:    1,
+			StatsDMaxPacketSize: 1432,
+			StatsDFlushInterval: 1000,
 		},
 
 		Cache: Cache{
-			Size:            5000,
-			TTL:             60,
-			MaxSizeAccepted: 60000,
-			NegSize:         500,
-			NegTTL:          30,
-			Active:          true,
+			Size:             5000,
+			TTL:              60,
+			MaxSizeAccepted:  60000,
+			NegSize:          500,
+			NegTTL:           30,
+			Active:           true,
+			SnapshotInterval: 60,
+			MaxFetchers:      100,
+			TTLJitter:        0.1,
+			EarlyRefreshBeta: 1,
+			WarmTopN:         50,
+			WarmInterval:     300,
+			WarmConcurrency:  2,
+			StatsSize:        1000,
+			L2Timeout:        50,
+			L2PoolSize:       10,
+			L2Sweep:          600,
+
+			HTTPMaxAge:               3600,
+			HTTPStaleWhileRevalidate: 60,
+		},
+
+		Peers: Peers{
+			Timeout: 500,
+			Retry:   5,
+		},
+
+		Compression: Compression{
+			Active:    true,
+			MinSize:   1024,
+			Encodings: []string{"zstd", "gzip", "deflate"},
+		},
+
+		RateLimit: RateLimit{
+			Active:  false,
+			Rate:    10,
+			Burst:   100,
+			Buckets: 10000,
+		},
+
+		Admission: Admission{
+			Active:       false,
+			Budget:       4000,
+			QueueTimeout: 200,
+		},
+
+		Auth: Auth{
+			Header:         "X-API-Key",
+			AllowAnonymous: true,
+		},
+
+		JWT: JWT{
+			ClockSkew:      60,
+			ReloadInterval: 10,
+			APIScope:       "fizzbuzz:read",
+			AdminScope:     "admin",
+			PProfScope:     "pprof",
+		},
+
+		Usage: Usage{
+			Active:        false,
+			FlushInterval: 10,
+		},
+
+		CORS: CORS{
+			Active:  true,
+			Origins: []string{"*"},
+			Methods: []string{"GET", "HEAD", "OPTIONS"},
+			Headers: []string{"Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "If-None-Match"},
+			ExposedHeaders: []string{"X-Request-ID", "X-Cache", "Age", "ETag", "X-Request-Cost", "Retry-After",
+				"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"},
+			MaxAge: 600,
+		},
+
+		Security: Security{
+			HSTSMaxAge: 31536000,
+		},
+
+		Tracing: Tracing{
+			Endpoint:      "http://127.0.0.1:4318/v1/traces",
+			SampleRatio:   1,
+			BatchSize:     512,
+			FlushInterval: 1000,
+			Timeout:       5000,
 		},
 	}
 }
@@ -154,6 +401,14 @@ func New() *Config {
 		cfg.Cache.Size = 10
 	}
 
+	if cfg.Cache.MaxFetchers < 1 {
+		cfg.Cache.MaxFetchers = 1
+	}
+
+	if cfg.Cache.WarmConcurrency > cfg.Cache.MaxFetchers {
+		cfg.Cache.WarmConcurrency = cfg.Cache.MaxFetchers
+	}
+
 	fmt.Println(fmt.Sprintf("%+v", cfg))
 	return cfg
 }
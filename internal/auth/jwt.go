@@ -0,0 +1,392 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by Verifier.Verify.
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrBadSignature   = errors.New("invalid token signature")
+	ErrExpired        = errors.New("token expired")
+	ErrNotYetValid    = errors.New("token not valid yet")
+	ErrBadIssuer      = errors.New("invalid token issuer")
+	ErrBadAudience    = errors.New("invalid token audience")
+)
+
+// Claims are the claims of a verified token.
+type Claims struct {
+	Subject  string
+	Issuer   string
+	Audience []string
+	Expiry   time.Time
+	Scopes   []string
+	Tier     string
+}
+
+// HasScope tells if the token grants scope.
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// jwk is a key of a JWKS file (RFC 7517). Only the fields of the supported keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`   // oct
+	N   string `json:"n"`   // RSA
+	E   string `json:"e"`   // RSA
+	Crv string `json:"crv"` // OKP
+	X   string `json:"x"`   // OKP
+}
+
+// verificationKey is a parsed key, able to verify the signatures of one algorithm.
+type verificationKey struct {
+	kid string
+	alg string
+	key interface{} // []byte, *rsa.PublicKey or ed25519.PublicKey
+}
+
+// Verifier verifies JWTs signed with HS256, RS256 or EdDSA (Ed25519) by the keys of a local
+// JWKS file, which is reloaded when it changes.
+type Verifier struct {
+	path     string
+	issuer   string
+	audience string
+	skew     time.Duration
+
+	lock    sync.RWMutex
+	keys    []verificationKey
+	modTime time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// VerifierOption is the type of option passed to NewVerifier.
+type VerifierOption func(*Verifier)
+
+// WithIssuer requires the tokens to be issued by iss.
+// Default: "" (any issuer)
+func WithIssuer(iss string) VerifierOption {
+	return func(v *Verifier) {
+		v.issuer = iss
+	}
+}
+
+// WithAudience requires the tokens to be intended for aud.
+// Default: "" (any audience)
+func WithAudience(aud string) VerifierOption {
+	return func(v *Verifier) {
+		v.audience = aud
+	}
+}
+
+// WithClockSkew sets the tolerance on the expiry and not-before times of the tokens.
+// Default: time.Minute
+func WithClockSkew(d time.Duration) VerifierOption {
+	return func(v *Verifier) {
+		v.skew = d
+	}
+}
+
+// WithReload checks every interval whether the JWKS file changed, and reloads it if so.
+// Default: 0 (never reloaded)
+func WithReload(interval time.Duration) VerifierOption {
+	return func(v *Verifier) {
+		if interval > 0 {
+			v.stop = make(chan struct{})
+			go v.reloadLoop(interval)
+		}
+	}
+}
+
+// NewVerifier loads the JWKS file at path and builds a Verifier.
+func NewVerifier(path string, opts ...VerifierOption) (*Verifier, error) {
+	v := &Verifier{
+		path: path,
+		skew: time.Minute,
+	}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	for _, o := range opts {
+		o(v)
+	}
+	return v, nil
+}
+
+// Close stops reloading the JWKS file.
+func (v *Verifier) Close() {
+	v.once.Do(func() {
+		if v.stop != nil {
+			close(v.stop)
+		}
+	})
+}
+
+// Reload reads the JWKS file again. On error, the previous keys are kept.
+func (v *Verifier) Reload() error {
+	info, err := os.Stat(v.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS file %s: %w", v.path, err)
+	}
+
+	v.lock.Lock()
+	v.keys = keys
+	v.modTime = info.ModTime()
+	v.lock.Unlock()
+	return nil
+}
+
+// reloadLoop reloads the JWKS file when its modification time changes.
+func (v *Verifier) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(v.path)
+			if err != nil {
+				continue
+			}
+			v.lock.RLock()
+			changed := !info.ModTime().Equal(v.modTime)
+			v.lock.RUnlock()
+			if changed {
+				_ = v.Reload()
+			}
+		case <-v.stop:
+			return
+		}
+	}
+}
+
+// Verify checks the signature and the claims of a token.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !v.verifySignature(header.Alg, header.Kid, signed, sig) {
+		return nil, ErrBadSignature
+	}
+
+	var raw struct {
+		Sub   string          `json:"sub"`
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   *float64        `json:"exp"`
+		Nbf   *float64        `json:"nbf"`
+		Scope string          `json:"scope"`
+		Scp   []string        `json:"scp"`
+		Tier  string          `json:"tier"`
+	}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	claims := &Claims{Subject: raw.Sub, Issuer: raw.Iss, Tier: raw.Tier, Scopes: raw.Scp}
+	if raw.Scope != "" {
+		claims.Scopes = append(claims.Scopes, strings.Fields(raw.Scope)...)
+	}
+	if len(raw.Aud) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Aud, &one); err == nil {
+			claims.Audience = []string{one}
+		} else if err := json.Unmarshal(raw.Aud, &claims.Audience); err != nil {
+			return nil, ErrMalformedToken
+		}
+	}
+
+	now := time.Now()
+	if raw.Exp == nil {
+		return nil, ErrExpired
+	}
+	claims.Expiry = time.Unix(int64(*raw.Exp), 0)
+	if now.After(claims.Expiry.Add(v.skew)) {
+		return nil, ErrExpired
+	}
+	if raw.Nbf != nil && now.Add(v.skew).Before(time.Unix(int64(*raw.Nbf), 0)) {
+		return nil, ErrNotYetValid
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, ErrBadIssuer
+	}
+	if v.audience != "" {
+		found := false
+		for _, aud := range claims.Audience {
+			if aud == v.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrBadAudience
+		}
+	}
+	return claims, nil
+}
+
+// verifySignature checks the signature of a token with the keys of its algorithm. The "none"
+// algorithm is never accepted, and a key is only used with the algorithm of its type.
+func (v *Verifier) verifySignature(alg, kid string, signed, sig []byte) bool {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	for _, k := range v.keys {
+		if k.alg != alg || (kid != "" && k.kid != kid) {
+			continue
+		}
+		switch key := k.key.(type) {
+		case []byte:
+			mac := hmac.New(sha256.New, key)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return true
+			}
+		case *rsa.PublicKey:
+			h := sha256.Sum256(signed)
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, signed, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseJWKS reads the supported keys of a JWKS document.
+func parseJWKS(b []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []verificationKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		vk := verificationKey{kid: k.Kid}
+		switch k.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("bad oct key %q", k.Kid)
+			}
+			vk.alg, vk.key = "HS256", secret
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("bad RSA key %q", k.Kid)
+			}
+			vk.alg = "RS256"
+			vk.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("bad OKP key %q", k.Kid)
+			}
+			vk.alg, vk.key = "EdDSA", ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		if k.Alg != "" && k.Alg != vk.alg {
+			return nil, fmt.Errorf("unsupported algorithm %s for key %q", k.Alg, k.Kid)
+		}
+		keys = append(keys, vk)
+	}
+	return keys, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// BearerToken returns the bearer token of the Authorization header of a request, if any.
+func BearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// IsJWT tells if a bearer token looks like a JWT rather than an API key.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Require returns a handler serving next only for the requests with a valid token granting scope.
+// It responds 401 without valid token, and 403 if the token doesn't grant the scope.
+func (v *Verifier) Require(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.Verify(BearerToken(r))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !claims.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, "missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+// Package auth authenticates the clients of the API with API keys, or with JWTs verified by
+// the keys of a JWKS file.
+//
+// Keys are listed in a YAML file with their hashed secret and their tier:
+//
+//	tiers:
+//	  pro:
+//	    max_limit: 100000
+//	    rate: 50
+//	    burst: 500
+//	    daily_quota: 1000000
+//	    monthly_quota: 20000000
+//	keys:
+//	  - id: acme
+//	    tier: pro
+//	    secret_sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//
+// The hash of a secret is the hex encoded SHA-256 of the key sent by the client,
+// e.g. `printf %s "$key" | sha256sum`.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Tier sets the limits of the clients of a kind. Zero values keep the default limits.
+// Quotas are counted in items served, zero quotas are unlimited.
+type Tier struct {
+	Name         string  `yaml:"-"`
+	MaxLimit     int     `yaml:"max_limit"`
+	MaxNb        int     `yaml:"max_nb"`
+	MaxStrChar   int     `yaml:"max_str_char"`
+	Rate         float64 `yaml:"rate"`
+	Burst        int     `yaml:"burst"`
+	DailyQuota   int64   `yaml:"daily_quota"`
+	MonthlyQuota int64   `yaml:"monthly_quota"`
+}
+
+// Key is an API key.
+type Key struct {
+	ID           string `yaml:"id"`
+	Tier         string `yaml:"tier"`
+	SecretSHA256 string `yaml:"secret_sha256"`
+}
+
+// DefaultTier is the tier of the clients without a known tier: it keeps the default limits.
+var DefaultTier = &Tier{Name: "default"}
+
+// Client is an authenticated client.
+type Client struct {
+	KeyID string
+	Tier  *Tier
+}
+
+// Keys is a set of API keys, looked up by the hash of their secret.
+type Keys struct {
+	tiers  map[string]*Tier
+	byHash map[string]*Client
+}
+
+type keysFile struct {
+	Tiers map[string]*Tier `yaml:"tiers"`
+	Keys  []Key            `yaml:"keys"`
+}
+
+// LoadKeys reads a file of API keys.
+func LoadKeys(path string) (*Keys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keysFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("invalid keys file %s: %w", path, err)
+	}
+
+	k := &Keys{tiers: make(map[string]*Tier), byHash: make(map[string]*Client)}
+	for name, tier := range f.Tiers {
+		if tier == nil {
+			tier = &Tier{}
+		}
+		tier.Name = name
+		k.tiers[name] = tier
+	}
+	for _, key := range f.Keys {
+		if key.ID == "" {
+			return nil, fmt.Errorf("invalid keys file %s: key without id", path)
+		}
+		tier, ok := k.tiers[key.Tier]
+		if !ok {
+			return nil, fmt.Errorf("invalid keys file %s: unknown tier %q for key %s", path, key.Tier, key.ID)
+		}
+		hash := strings.ToLower(key.SecretSHA256)
+		if len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid keys file %s: bad secret hash for key %s", path, key.ID)
+		}
+		k.byHash[hash] = &Client{KeyID: key.ID, Tier: tier}
+	}
+	return k, nil
+}
+
+// Lookup returns the client owning an API key.
+func (k *Keys) Lookup(key string) (*Client, bool) {
+	if k == nil || key == "" {
+		return nil, false
+	}
+	c, ok := k.byHash[HashSecret(key)]
+	return c, ok
+}
+
+// Tier returns the tier named name, or DefaultTier.
+func (k *Keys) Tier(name string) *Tier {
+	if k == nil {
+		return DefaultTier
+	}
+	if tier, ok := k.tiers[name]; ok {
+		return tier
+	}
+	return DefaultTier
+}
+
+// Tiers returns the tiers of the keys.
+func (k *Keys) Tiers() []*Tier {
+	if k == nil {
+		return nil
+	}
+	tiers := make([]*Tier, 0, len(k.tiers))
+	for _, t := range k.tiers {
+		tiers = append(tiers, t)
+	}
+	return tiers
+}
+
+// Len returns the number of keys.
+func (k *Keys) Len() int {
+	if k == nil {
+		return 0
+	}
+	return len(k.byHash)
+}
+
+// HashSecret returns the hash of an API key, as stored in the keys file.
+func HashSecret(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+type ctxKey struct{}
+
+// ToContext returns a copy of ctx carrying the authenticated client.
+func ToContext(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, ctxKey{}, c)
+}
+
+// FromContext returns the authenticated client carried by ctx, if any.
+func FromContext(ctx context.Context) (*Client, bool) {
+	c, ok := ctx.Value(ctxKey{}).(*Client)
+	return c, ok && c != nil
+}
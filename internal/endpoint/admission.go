@@ -0,0 +1,93 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ariden83/fizz-buzz/internal/xcache"
+)
+
+const (
+	RequestCostHeaderKey = "X-Request-Cost"
+	// costUnit is the estimated response size of a request costing 1.
+	costUnit = 1024
+)
+
+// cost estimates the cost of a request from its parameters, as the size of its response
+// in cost units (KB). It is an upper bound: every number is counted with the digits of limit.
+func (p getFizzBuzzParams) cost() int64 {
+	if p.Limit <= 0 {
+		return 1
+	}
+	limit := int64(p.Limit)
+	// numbers and commas
+	size := limit * int64(len(strconv.Itoa(p.Limit))+1)
+	if p.NBOne > 0 {
+		size += limit / int64(p.NBOne) * int64(len(p.StrOne))
+	}
+	if p.NBTwo > 0 {
+		size += limit / int64(p.NBTwo) * int64(len(p.StrTwo))
+	}
+	if cost := size / costUnit; cost > 1 {
+		return cost
+	}
+	return 1
+}
+
+// errShed is the error of a sequence shed by the admission.
+var errShed = errors.New("too many requests in progress, retry later")
+
+// observeCost sends the estimated cost of a request in the RequestCostHeaderKey header.
+func (s *Endpoint) observeCost(w http.ResponseWriter, r *http.Request, p getFizzBuzzParams) {
+	if s.admission == nil {
+		return
+	}
+	cost := p.cost()
+	w.Header().Set(RequestCostHeaderKey, strconv.FormatInt(cost, 10))
+	s.metrics.RequestCost.WithLabelValues(routeLabel(r)).Observe(float64(cost))
+}
+
+// admit enforces the cost budget of Admission.Budget on the generation of a sequence, which
+// waits at most Admission.QueueTimeout for its cost to fit in the budget and fails with errShed
+// beyond. It returns the function releasing the cost once the sequence is generated.
+// The sequences served from the cache don't go through the admission.
+func (s *Endpoint) admit(ctx context.Context, route string, p getFizzBuzzParams) (func(), error) {
+	if s.admission == nil {
+		return func() {}, nil
+	}
+	admitted, ok := s.admission.Acquire(ctx, p.cost())
+	if !ok {
+		s.metrics.AdmissionShed.WithLabelValues(route).Inc()
+		return nil, errShed
+	}
+	s.metrics.AdmissionInUse.Set(float64(s.admission.InUse()))
+	return func() {
+		s.admission.Release(admitted)
+		s.metrics.AdmissionInUse.Set(float64(s.admission.InUse()))
+	}, nil
+}
+
+// admitFetcher wraps the fetcher of a sequence with the admission. A shed fetch fails with
+// a transient error, which isn't stored in the negative cache. As the fetcher may refresh the
+// entry after the request, it doesn't wait for the request context.
+func (s *Endpoint) admitFetcher(route string, p getFizzBuzzParams, f xcache.ResultFetcher) xcache.ResultFetcher {
+	if s.admission == nil {
+		return f
+	}
+	return func() (xcache.Result, error) {
+		release, err := s.admit(context.Background(), route, p)
+		if err != nil {
+			return xcache.Result{}, xcache.Transient(err)
+		}
+		defer release()
+		return f()
+	}
+}
+
+// shed rejects a request shed by the admission.
+func (s *Endpoint) shed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	s.fail(http.StatusServiceUnavailable, errShed, w, r)
+}
@@ -0,0 +1,164 @@
+package endpoint
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ariden83/fizz-buzz/config"
+	"github.com/ariden83/fizz-buzz/internal/auth"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	AuthorizationHeaderKey = "Authorization"
+
+	authResultOK        = "ok"
+	authResultAnonymous = "anonymous"
+	authResultMissing   = "missing"
+	authResultInvalid   = "invalid"
+	authResultForbidden = "forbidden"
+
+	// jwtKeyPrefix prefixes the subject of a JWT in the key ID of its client.
+	jwtKeyPrefix = "jwt:"
+	// keyLabelJWT is the key_id label of the clients authenticated by JWT, whose subjects are unbounded.
+	keyLabelJWT = "jwt"
+)
+
+// WithAuth loads the API keys of Auth.KeysPath. Without keys, every client is anonymous.
+// It fails if the keys can't be loaded.
+func WithAuth() Option {
+	return func(s *Endpoint) error {
+		if s.conf.Auth.KeysPath == "" {
+			return nil
+		}
+		keys, err := auth.LoadKeys(s.conf.Auth.KeysPath)
+		if err != nil {
+			return fmt.Errorf("fail to load API keys of %s: %w", s.conf.Auth.KeysPath, err)
+		}
+		s.keys = keys
+		s.log.Info("API keys loaded", zap.String("path", s.conf.Auth.KeysPath), zap.Int("keys", keys.Len()))
+		return nil
+	}
+}
+
+// WithJWT validates the JWTs sent as bearer tokens with v. The tokens must grant JWT.APIScope.
+func WithJWT(v *auth.Verifier) Option {
+	return func(s *Endpoint) error {
+		s.jwt = v
+		return nil
+	}
+}
+
+// authenticate is a negroni middleware identifying the client from its JWT or its API key,
+// sent in the Auth.Header header or as a bearer token. Requests with an invalid token or an
+// unknown key are rejected, and requests without credentials are rejected unless
+// Auth.AllowAnonymous is set.
+func (s *Endpoint) authenticate(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if token := auth.BearerToken(r); s.jwt != nil && auth.IsJWT(token) {
+		claims, err := s.jwt.Verify(token)
+		if err != nil {
+			s.metrics.AuthRequests.WithLabelValues("", "", authResultInvalid).Inc()
+			s.unauthorized(w, r, err)
+			return
+		}
+		client := &auth.Client{KeyID: jwtKeyPrefix + claims.Subject, Tier: s.keys.Tier(claims.Tier)}
+		if scope := s.conf.JWT.APIScope; scope != "" && !claims.HasScope(scope) {
+			s.metrics.AuthRequests.WithLabelValues(keyLabel(client), client.Tier.Name, authResultForbidden).Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			s.fail(http.StatusForbidden, fmt.Errorf("missing scope %s", scope), w, r)
+			return
+		}
+		s.authenticated(w, r, next, client)
+		return
+	}
+
+	key := apiKey(r, s.conf.Auth.Header)
+	if key == "" {
+		if !s.conf.Auth.AllowAnonymous {
+			s.metrics.AuthRequests.WithLabelValues("", "", authResultMissing).Inc()
+			s.unauthorized(w, r, fmt.Errorf("missing API key"))
+			return
+		}
+		s.metrics.AuthRequests.WithLabelValues("", "", authResultAnonymous).Inc()
+		next(w, r)
+		return
+	}
+
+	client, ok := s.keys.Lookup(key)
+	if !ok {
+		s.metrics.AuthRequests.WithLabelValues("", "", authResultInvalid).Inc()
+		s.unauthorized(w, r, fmt.Errorf("invalid API key"))
+		return
+	}
+	s.authenticated(w, r, next, client)
+}
+
+// authenticated serves the request of an authenticated client.
+func (s *Endpoint) authenticated(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, client *auth.Client) {
+	s.metrics.AuthRequests.WithLabelValues(keyLabel(client), client.Tier.Name, authResultOK).Inc()
+	logger.AddFields(r.Context(), zap.String("key_id", client.KeyID))
+	next(w, r.WithContext(auth.ToContext(r.Context(), client)))
+}
+
+// keyLabel returns the key_id label of a client: the ID of its API key, or keyLabelJWT.
+func keyLabel(client *auth.Client) string {
+	if strings.HasPrefix(client.KeyID, jwtKeyPrefix) {
+		return keyLabelJWT
+	}
+	return client.KeyID
+}
+
+// unauthorized rejects a request without valid credentials.
+func (s *Endpoint) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.conf.Name+`"`)
+	s.fail(http.StatusUnauthorized, err, w, r)
+}
+
+// apiKey returns the API key sent in header, or as a bearer token.
+func apiKey(r *http.Request, header string) string {
+	if header != "" {
+		if key := r.Header.Get(header); key != "" {
+			return key
+		}
+	}
+	return auth.BearerToken(r)
+}
+
+// parameters returns the limits of the parameters of a request: the ones of the tier of
+// its client, defaulting to Parameters.
+func (s *Endpoint) parameters(r *http.Request) config.Parameters {
+	limits := s.conf.Parameters
+	if client, ok := auth.FromContext(r.Context()); ok {
+		tier := client.Tier
+		if tier.MaxLimit > 0 {
+			limits.MaxLimit = tier.MaxLimit
+		}
+		if tier.MaxNb > 0 {
+			limits.MaxNb = tier.MaxNb
+		}
+		if tier.MaxStrChar > 0 {
+			limits.MaxStrChar = tier.MaxStrChar
+		}
+	}
+	return limits
+}
+
+// widestParameters returns the widest limits of the parameters among Parameters and the tiers,
+// to decode the parameters validated by another replica or counted by the warmer.
+func (s *Endpoint) widestParameters() config.Parameters {
+	limits := s.conf.Parameters
+	for _, tier := range s.keys.Tiers() {
+		if tier.MaxLimit > limits.MaxLimit {
+			limits.MaxLimit = tier.MaxLimit
+		}
+		if tier.MaxNb > limits.MaxNb {
+			limits.MaxNb = tier.MaxNb
+		}
+		if tier.MaxStrChar > limits.MaxStrChar {
+			limits.MaxStrChar = tier.MaxStrChar
+		}
+	}
+	return limits
+}
@@ -0,0 +1,68 @@
+package endpoint
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ETagHeaderKey         = "ETag"
+	IfNoneMatchHeaderKey  = "If-None-Match"
+	CacheControlHeaderKey = "Cache-Control"
+)
+
+// etag returns the strong ETag of the response for the given parameters. A response only
+// depends on its parameters, its format and the build version, so the ETag is computed
+// from them without generating the body.
+func (e *Endpoint) etag(p getFizzBuzzParams) string {
+	h := sha1.New()
+	h.Write([]byte(e.version + "\n" + p.format() + "\n" + p.canonical()))
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// cacheControl returns the Cache-Control header of the responses, set from
+// Cache.HTTPMaxAge and Cache.HTTPStaleWhileRevalidate.
+func (e *Endpoint) cacheControl() string {
+	if e.conf.Cache.HTTPMaxAge <= 0 {
+		return "no-cache"
+	}
+	cc := "public, max-age=" + strconv.Itoa(e.conf.Cache.HTTPMaxAge)
+	if e.conf.Cache.HTTPStaleWhileRevalidate > 0 {
+		cc += ", stale-while-revalidate=" + strconv.Itoa(e.conf.Cache.HTTPStaleWhileRevalidate)
+	}
+	return cc
+}
+
+// setValidators sets the caching headers of a response, and tells if the client already
+// has it: in that case, a 304 is sent and nothing else must be written.
+func (e *Endpoint) setValidators(w http.ResponseWriter, r *http.Request, p getFizzBuzzParams) bool {
+	etag := e.etag(p)
+	w.Header().Set(ETagHeaderKey, etag)
+	w.Header().Set(CacheControlHeaderKey, e.cacheControl())
+	// the format depends on the Content-Type of the request
+	w.Header().Add("Vary", "Content-Type")
+
+	if !noneMatch(r.Header.Get(IfNoneMatchHeaderKey), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// noneMatch tells if none of the entity tags listed in an If-None-Match header matches etag,
+// using the weak comparison of RFC 7232.
+func noneMatch(header, etag string) bool {
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return false
+		}
+	}
+	return true
+}
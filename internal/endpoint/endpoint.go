@@ -2,86 +2,229 @@ package endpoint
 
 import (
 	"context"
+	"fmt"
 	"github.com/ariden83/fizz-buzz/config"
+	"github.com/ariden83/fizz-buzz/internal/auth"
 	"github.com/ariden83/fizz-buzz/internal/metrics"
 	middle "github.com/ariden83/fizz-buzz/internal/middleware"
+	"github.com/ariden83/fizz-buzz/internal/topk"
+	"github.com/ariden83/fizz-buzz/internal/usage"
 	"github.com/ariden83/fizz-buzz/internal/xcache"
 	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
 	"github.com/dimfeld/httptreemux"
 	"github.com/gofrs/uuid"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/negroni"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Endpoint struct {
-	log        *zap.Logger
-	metrics    *metrics.Metrics
-	conf       *config.Config
-	server     *http.Server
-	fetching   map[string]struct{}
-	xcache     *xcache.Cache // cache for valid entries
-	queuedLock sync.Mutex
-	queued     map[string]struct{}
-	fetchQueue chan string
-	fetchLock  sync.Mutex
-	fetchCond  *sync.Cond
+	log            *zap.Logger
+	metrics        *metrics.Metrics
+	conf           *config.Config
+	version        string
+	serverLock     sync.Mutex // guard "server", "peerServer" and "shutdown"
+	server         *http.Server
+	peerServer     *http.Server
+	shutdown       bool // the servers don't start once the endpoint is shut down
+	fetching       map[string]struct{}
+	xcache         *xcache.Cache // cache for valid entries
+	stats          *topk.TopK    // most requested parameters
+	stopWarm       chan struct{} // stop the cache warmer
+	stopOnce       sync.Once     // guard closing of "stopWarm"
+	compressor     *middle.Compressor
+	limiter        *middle.RateLimiter
+	keys           *auth.Keys     // API keys, nil if none
+	jwt            *auth.Verifier // JWT verifier, nil if none
+	admission      *middle.CostLimiter
+	cors           *middle.CORS
+	recovery       *middle.Recovery
+	accessLog      *middle.AccessLog
+	usage          *usage.Meter // items served per client, nil if not accounted
+	tracer         trace.Tracer // nil if the requests aren't traced
+	tracerProvider *sdktrace.TracerProvider
+	queuedLock     sync.Mutex
+	queued         map[string]struct{}
+	fetchQueue     chan string
+	fetchLock      sync.Mutex
+	fetchCond      *sync.Cond
 }
 
 const (
-	RequestIDHeaderKey = "X-Request-ID"
-	RequestIDKey       = "RequestID"
-	ContentTypeJSON    = "application/json"
+	RequestIDHeaderKey   = "X-Request-ID"
+	RequestIDKey         = "RequestID"
+	ContentTypeJSON      = "application/json"
+	CacheStatusHeaderKey = "X-Cache"
+	// CacheStatusBypass is the cache status of responses computed without xcache
+	CacheStatusBypass = "BYPASS"
+	// CacheStatusNone is the cache status label of requests which didn't reach the cache
+	CacheStatusNone = "NONE"
+	// RouteUnmatched is the route label of requests which weren't routed
+	RouteUnmatched = "unmatched"
+	// MethodOther is the method label of requests with a non standard method
+	MethodOther = "OTHER"
+)
+
+// kinds of rate limit keys
+const (
+	rateLimitByIP  = "ip"
+	rateLimitByKey = "key"
 )
 
 type EndPointInput struct {
 	Config  *config.Config
 	Log     *zap.Logger
 	Metrics *metrics.Metrics
+	Version string // build version, part of the ETag of the responses
 }
 
-// Option is the type of option passed to the constructor.
-type Option func(e *Endpoint)
+// Option is the type of option passed to the constructor, which fails if it returns an error.
+type Option func(e *Endpoint) error
 
-func New(input EndPointInput, opts ...Option) *Endpoint {
+func New(input EndPointInput, opts ...Option) (*Endpoint, error) {
 
 	e := &Endpoint{
 		log:        input.Log.With(zap.String("component", "http")),
 		metrics:    input.Metrics,
 		conf:       input.Config,
+		version:    input.Version,
 		fetchQueue: make(chan string, 1000),
 		fetching:   make(map[string]struct{}),
 		queued:     make(map[string]struct{}),
+		stats:      topk.New(input.Config.Cache.StatsSize),
 	}
 	e.fetchCond = sync.NewCond(&e.fetchLock)
+	// the most requested parameters are exported in place of a series per parameter set
+	e.metrics.ApiParams.Watch(e.stats)
+	e.recovery = middle.NewRecovery(middle.WithPanicFunc(e.panicked))
+
+	if e.conf.Logger.AccessLog {
+		e.accessLog = middle.NewAccessLog(middle.WithTrustedProxies(e.conf.RateLimit.TrustedProxies))
+	}
+
+	if e.conf.RateLimit.Active {
+		e.limiter = middle.NewRateLimiter(
+			middle.WithKeyFunc(e.rateLimitKey),
+			middle.WithRejectFunc(e.rateLimited),
+			middle.WithBuckets(e.conf.RateLimit.Buckets))
+	}
+
+	if e.conf.Admission.Active {
+		e.admission = middle.NewCostLimiter(int64(e.conf.Admission.Budget),
+			time.Duration(e.conf.Admission.QueueTimeout)*time.Millisecond)
+	}
+
+	if e.conf.CORS.Active {
+		e.cors = middle.NewCORS(
+			middle.WithAllowedOrigins(e.conf.CORS.Origins...),
+			middle.WithAllowedMethods(e.conf.CORS.Methods...),
+			middle.WithAllowedHeaders(e.conf.CORS.Headers...),
+			middle.WithExposedHeaders(e.conf.CORS.ExposedHeaders...),
+			middle.WithCredentials(e.conf.CORS.Credentials),
+			middle.WithMaxAge(time.Duration(e.conf.CORS.MaxAge)*time.Second))
+	}
+
+	if e.conf.Compression.Active {
+		e.compressor = middle.NewCompressor(
+			middle.WithMinSize(e.conf.Compression.MinSize),
+			middle.WithEncodings(e.conf.Compression.Encodings...),
+			middle.WithSizeObserver(e.observeBodySize))
+	}
 
 	for _, o := range opts {
-		o(e)
+		if err := o(e); err != nil {
+			return nil, err
+		}
 	}
 
-	return e
+	return e, nil
 }
 
 func WithXCache() Option {
-	return func(s *Endpoint) {
-		var err error
+	return func(s *Endpoint) error {
+		backend, err := s.newCacheBackend()
+		if err != nil {
+			s.log.Error("fail to init xcache backend, using memory only", zap.Error(err))
+			backend = nil
+		}
+
+		var peers xcache.PeerPicker
+		if s.conf.Peers.Self != "" {
+			peers = xcache.NewHTTPPool(s.conf.Peers.Self, s.conf.Peers.Addrs, s.conf.Peers.Secret,
+				time.Duration(s.conf.Peers.Timeout)*time.Millisecond,
+				time.Duration(s.conf.Peers.Retry)*time.Second)
+		}
 
 		s.xcache, err = xcache.New(
 			xcache.WithSize(int32(s.conf.Cache.Size)),
 			xcache.WithTTL(time.Duration(s.conf.Cache.TTL)*time.Second),
+			xcache.WithTTLJitter(s.conf.Cache.TTLJitter),
+			xcache.WithEarlyRefresh(s.conf.Cache.EarlyRefreshBeta),
 			xcache.WithNegSize(int32(s.conf.Cache.NegSize)),
 			xcache.WithNegTTL(time.Duration(s.conf.Cache.NegTTL)*time.Second),
 			xcache.WithStale(true),
-			xcache.WithPruneSize(int32(s.conf.Cache.Size/20)+1))
+			xcache.WithPruneSize(int32(s.conf.Cache.Size/20)+1),
+			xcache.WithFetchers(s.conf.Cache.MaxFetchers),
+			xcache.WithCodec(xcache.BytesCodec{}),
+			xcache.WithSnapshot(s.conf.Cache.SnapshotPath, time.Duration(s.conf.Cache.SnapshotInterval)*time.Second),
+			xcache.WithBackend(backend),
+			xcache.WithBackendSweep(time.Duration(s.conf.Cache.L2Sweep)*time.Second),
+			xcache.WithPeers(peers),
+			xcache.WithLoader(s.loadKey),
+			xcache.WithPeerSecret(s.conf.Peers.Secret),
+			xcache.WithPanicHandler(s.fetchPanicked))
 
 		if err != nil {
 			s.log.Error("fail to init xcache", zap.Error(err))
+			return nil
+		}
+		s.metrics.ObserveCacheStats(s.xcache)
+
+		if s.conf.Cache.SnapshotPath != "" {
+			n, err := s.xcache.LoadSnapshot()
+			if err != nil {
+				s.log.Error("fail to load xcache snapshot", zap.String("path", s.conf.Cache.SnapshotPath), zap.Error(err))
+				return nil
+			}
+			s.log.Info("xcache warmed from snapshot", zap.String("path", s.conf.Cache.SnapshotPath), zap.Int("entries", n))
 		}
+		return nil
+	}
+}
+
+// newCacheBackend builds the second tier of xcache set in the configuration, if any.
+func (s *Endpoint) newCacheBackend() (xcache.Backend, error) {
+	switch s.conf.Cache.L2Backend {
+	case "":
+		return nil, nil
+	case "file":
+		return xcache.NewFileBackend(s.conf.Cache.L2Path)
+	case "redis":
+		timeout := time.Duration(s.conf.Cache.L2Timeout) * time.Millisecond
+		return xcache.NewRedisBackend(s.conf.Cache.L2Addr, timeout, s.conf.Cache.L2PoolSize), nil
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", s.conf.Cache.L2Backend)
+}
+
+// InvalidateCache removes from xcache the responses having the given tag (see WordTag() and NumberTag()),
+// and returns the number of responses removed.
+func (s *Endpoint) InvalidateCache(tag string) int {
+	if s.xcache == nil {
+		return 0
+	}
+	return s.xcache.InvalidateTag(tag)
+}
+
+// PurgeCache removes every response from xcache.
+func (s *Endpoint) PurgeCache() {
+	if s.xcache != nil {
+		s.xcache.Purge()
 	}
 }
 
@@ -103,61 +246,278 @@ func (s *Endpoint) RequestIDHeader(w http.ResponseWriter, r *http.Request, next
 	w.Header().Set(RequestIDHeaderKey, reqID)
 	ctx := context.WithValue(r.Context(), RequestIDKey, reqID)
 	ctx = logger.ToContext(ctx, s.log.With(zap.String(RequestIDKey, reqID)))
-	next(w, r)
+	ctx = middle.TrackRoute(ctx)
+	next(w, r.WithContext(ctx))
+}
+
+// handle registers a route, recording its template for the middlewares (see middle.Route).
+func (s *Endpoint) handle(mux *httptreemux.TreeMux, method, path string, h httptreemux.HandlerFunc) {
+	mux.Handle(method, path, func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		middle.SetRoute(r, path)
+		h(w, r, params)
+	})
 }
 
 func (s *Endpoint) Shutdown(ctx context.Context) {
-	s.log.Debug("Gracefully pausing down the HTTP server", zap.String("address", s.server.Addr))
-	s.server.Shutdown(ctx)
+	s.serverLock.Lock()
+	s.shutdown = true
+	server, peerServer := s.server, s.peerServer
+	s.serverLock.Unlock()
+
+	if server != nil {
+		s.log.Debug("Gracefully pausing down the HTTP server", zap.String("address", server.Addr))
+		server.Shutdown(ctx)
+	}
+
+	if peerServer != nil {
+		peerServer.Shutdown(ctx)
+	}
+
+	if s.stopWarm != nil {
+		s.stopOnce.Do(func() {
+			close(s.stopWarm)
+		})
+	}
+
+	if s.xcache != nil {
+		if err := s.xcache.Close(); err != nil {
+			s.log.Error("fail to write xcache snapshot", zap.Error(err))
+		}
+	}
+
+	if s.usage != nil {
+		if err := s.usage.Close(); err != nil {
+			s.log.Error("fail to write usage store", zap.Error(err))
+		}
+	}
+
+	if s.tracerProvider != nil {
+		if err := s.tracerProvider.Shutdown(ctx); err != nil {
+			s.log.Error("fail to export the last spans", zap.Error(err))
+		}
+	}
 }
 
 func (s *Endpoint) LoadHttpTreeMux() *negroni.Negroni {
 	mux := httptreemux.New()
+	// HEAD is served by the GET handlers, the server discarding the body
+	mux.HeadCanUseGet = true
+	mux.OptionsHandler = s.options
 
-	mux.Handle("GET", "/fizz-buzz", s.GetFizzBuzz)
+	s.handle(mux, "GET", "/fizz-buzz", s.GetFizzBuzz)
+	if s.usage != nil {
+		s.handle(mux, "GET", "/usage", s.GetUsage)
+	}
 
 	n := negroni.New(negroni.HandlerFunc(middle.DefaultHeader))
+	n.UseFunc(middle.SecurityHeader(time.Duration(s.conf.Security.HSTSMaxAge) * time.Second))
 	n.UseFunc(s.RequestIDHeader)
+	if s.tracer != nil {
+		n.UseFunc(s.trace)
+	}
+	if s.accessLog != nil {
+		n.Use(s.accessLog)
+	}
 
-	n.Use(negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		route := strings.ToLower(r.Method)
-
-		jsonHandler := promhttp.InstrumentHandlerInFlight(
-			s.metrics.InFlight,
-
-			promhttp.InstrumentHandlerResponseSize(
-				s.metrics.ResponseSize.MustCurryWith(prometheus.Labels{"service": route}),
+	n.UseFunc(s.instrument)
 
-				promhttp.InstrumentHandlerRequestSize(
-					s.metrics.RequestSize.MustCurryWith(prometheus.Labels{"service": route}),
+	// after the instrumentation, so that the panics are counted as 500
+	n.Use(s.recovery)
 
-					promhttp.InstrumentHandlerCounter(
-						s.metrics.RouteCountReqs.MustCurryWith(prometheus.Labels{"service": route}),
+	// ahead of the authentication, preflight requests are sent without credentials
+	if s.cors != nil {
+		n.Use(s.cors)
+	}
 
-						promhttp.InstrumentHandlerDuration(
-							s.metrics.ResponseDuration.MustCurryWith(prometheus.Labels{"service": route}),
-							next)))))
+	// after the instrumentation, so that the rejected requests are counted
+	if s.keys != nil || s.jwt != nil || !s.conf.Auth.AllowAnonymous {
+		n.UseFunc(s.authenticate)
+	}
+	if s.limiter != nil {
+		n.Use(s.limiter)
+	}
 
-		jsonHandler.ServeHTTP(rw, r)
-	}))
+	// after the instrumentation, so that ResponseSize observes the compressed size
+	if s.compressor != nil {
+		n.Use(s.compressor)
+	}
 
 	n.UseHandler(mux)
 
 	return n
 }
 
+// options answers the OPTIONS requests which aren't CORS preflight requests: every route
+// is served for GET and HEAD.
+func (s *Endpoint) options(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// instrument is a negroni middleware counting the requests and observing their duration and
+// sizes. The metrics are labelled once the request is served, by the route template, the
+// status class and the cache status found in the response headers, so that their
+// cardinality doesn't depend on the requests.
+func (s *Endpoint) instrument(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	s.metrics.InFlight.Inc()
+	defer s.metrics.InFlight.Dec()
+
+	start := time.Now()
+	res := negroni.NewResponseWriter(rw)
+	next(res, r)
+
+	cache := res.Header().Get(CacheStatusHeaderKey)
+	if cache == "" {
+		cache = CacheStatusNone
+	}
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	traceID, _ := sampledTraceID(r.Context())
+
+	s.metrics.ObserveRequest(metrics.Request{
+		Method:       methodLabel(r),
+		Route:        routeLabel(r),
+		Status:       statusClass(status),
+		Cache:        cache,
+		Duration:     time.Since(start),
+		RequestSize:  requestSize(r),
+		ResponseSize: res.Size(),
+		TraceID:      traceID,
+	})
+}
+
+// routeLabel returns the route template of a request, RouteUnmatched if it wasn't routed.
+func routeLabel(r *http.Request) string {
+	if route := middle.Route(r); route != "" {
+		return route
+	}
+	return RouteUnmatched
+}
+
+// methodLabel returns the method of a request, MethodOther if it isn't a standard one.
+func methodLabel(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return r.Method
+	}
+	return MethodOther
+}
+
+// statusClass returns the class of a status code, such as "2xx".
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// requestSize approximates the size of a request on the wire, as promhttp does.
+func requestSize(r *http.Request) int {
+	size := len(r.Method) + len(r.Proto) + len(r.Host)
+	if r.URL != nil {
+		size += len(r.URL.String())
+	}
+	for name, values := range r.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	if r.ContentLength > 0 {
+		size += int(r.ContentLength)
+	}
+	return size
+}
+
+// observeBodySize observes the raw and wire size of a response body.
+func (s *Endpoint) observeBodySize(r *http.Request, encoding string, raw, wire int) {
+	route := routeLabel(r)
+	s.metrics.ResponseBodySize.WithLabelValues(route, encoding, "raw").Observe(float64(raw))
+	s.metrics.ResponseBodySize.WithLabelValues(route, encoding, "wire").Observe(float64(wire))
+}
+
 func (s *Endpoint) Listen(address string) error {
 	n := s.LoadHttpTreeMux()
 
 	s.log.Info("Listening HTTP server", zap.String("address", address))
-	s.server = &http.Server{
+	server := &http.Server{
 		Addr:         address,
 		Handler:      n,
 		ReadTimeout:  s.conf.APIReadTimeout * time.Second,
 		WriteTimeout: s.conf.APIWriteTimeout * time.Second,
 	}
-	if err := s.server.ListenAndServe(); err != nil {
+	if !s.setServer(&s.server, server) {
+		return http.ErrServerClosed
+	}
+	if err := server.ListenAndServe(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListenPeers serves to the other replicas the cache keys owned by this one, on Peers.Self.
+// The requests must carry Peers.Secret.
+func (s *Endpoint) ListenPeers() error {
+	if s.xcache == nil {
+		return fmt.Errorf("cannot serve peers without xcache")
+	}
+	if s.conf.Peers.Secret == "" {
+		return fmt.Errorf("cannot serve peers without peers_secret")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(xcache.PeersPath, s.xcache.PeerHandler())
+
+	s.log.Info("Listening HTTP peers server", zap.String("address", s.conf.Peers.Self))
+	peerServer := &http.Server{
+		Addr:         s.conf.Peers.Self,
+		Handler:      mux,
+		ReadTimeout:  s.conf.APIReadTimeout * time.Second,
+		WriteTimeout: s.conf.APIWriteTimeout * time.Second,
+	}
+	if !s.setServer(&s.peerServer, peerServer) {
+		return nil
+	}
+	if err := peerServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
+
+// setServer stores a server for Shutdown, unless the endpoint is shut down already in which
+// case it returns false and the server must not start.
+func (s *Endpoint) setServer(field **http.Server, server *http.Server) bool {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	if s.shutdown {
+		return false
+	}
+	*field = server
+	return true
+}
+
+// rateLimitKey returns the rate limit bucket of a request: its API key ID with the limits of
+// its tier if authenticated, its IP with the default limits otherwise.
+func (s *Endpoint) rateLimitKey(r *http.Request) (string, middle.Limit) {
+	limit := middle.Limit{Rate: s.conf.RateLimit.Rate, Burst: s.conf.RateLimit.Burst}
+	if client, ok := auth.FromContext(r.Context()); ok {
+		if client.Tier.Rate > 0 {
+			limit.Rate = client.Tier.Rate
+		}
+		if client.Tier.Burst > 0 {
+			limit.Burst = client.Tier.Burst
+		}
+		return rateLimitByKey + ":" + client.KeyID, limit
+	}
+	return rateLimitByIP + ":" + middle.ClientIP(r, s.conf.RateLimit.TrustedProxies), limit
+}
+
+// rateLimited rejects a request over its rate limit.
+func (s *Endpoint) rateLimited(w http.ResponseWriter, r *http.Request, key string) {
+	by := strings.SplitN(key, ":", 2)[0]
+	// the limiter runs before the router, the route isn't known yet
+	s.metrics.RateLimited.WithLabelValues(methodLabel(r), by).Inc()
+	s.fail(http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded, retry in %s seconds", w.Header().Get("Retry-After")), w, r)
+}
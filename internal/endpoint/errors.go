@@ -3,6 +3,7 @@ package endpoint
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
 	"go.uber.org/zap"
 	"net/http"
 )
@@ -26,6 +27,9 @@ type ErrorResponse struct {
 
 // fail Respond error to json format
 func (m *Endpoint) fail(statusCode int, err error, w http.ResponseWriter, r *http.Request) {
+	// errors must not be cached as the response
+	w.Header().Del(ETagHeaderKey)
+	w.Header().Set(CacheControlHeaderKey, "no-store")
 	w.WriteHeader(statusCode)
 
 	if r.Header.Get("Content-type") == "application/json" {
@@ -35,11 +39,11 @@ func (m *Endpoint) fail(statusCode int, err error, w http.ResponseWriter, r *htt
 		}
 		js, err := json.Marshal(error)
 		if err != nil {
-			m.log.Error("Fail to json.Marshal in Patch method", zap.Error(err))
+			logger.WithContext(r.Context()).Error("Fail to json.Marshal in Patch method", zap.Error(err))
 			return
 		}
 		if _, err := w.Write(js); err != nil {
-			m.log.Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
+			logger.WithContext(r.Context()).Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
 		}
 		return
 	}
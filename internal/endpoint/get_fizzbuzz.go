@@ -1,8 +1,16 @@
 package endpoint
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	middle "github.com/ariden83/fizz-buzz/internal/middleware"
+	"github.com/ariden83/fizz-buzz/config"
+	"github.com/ariden83/fizz-buzz/internal/tracing"
+	"github.com/ariden83/fizz-buzz/internal/xcache"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"net/http"
 	"net/url"
@@ -12,6 +20,11 @@ import (
 
 type Resp string
 
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
 type JsonResp struct {
 	Txt string `json:"txt"`
 }
@@ -30,6 +43,24 @@ type getFizzBuzzResp struct {
 	// X-Request-Id
 	// in: header
 	XRequestID string `json:"X-Request-Id"`
+	// X-Cache: HIT, MISS, STALE, NEGATIVE or BYPASS
+	// in: header
+	XCache string `json:"X-Cache"`
+	// Age of the cached response in seconds
+	// in: header
+	Age string `json:"Age"`
+	// ETag of the response, derived from the parameters, the format and the build version
+	// in: header
+	ETag string `json:"ETag"`
+	// Cache-Control
+	// in: header
+	CacheControl string `json:"Cache-Control"`
+	// Content-Encoding: gzip, deflate or zstd, negotiated from Accept-Encoding
+	// in: header
+	ContentEncoding string `json:"Content-Encoding"`
+	// X-Request-Cost: estimated cost of the request, in KB of response
+	// in: header
+	XRequestCost string `json:"X-Request-Cost"`
 	// corps of Response
 	// in: body
 	Body JsonResp `json:"body"`
@@ -46,9 +77,28 @@ type getFizzBuzzReq struct {
 	// X-Request-Id
 	// in: header
 	XRequestID string `json:"X-Request-Id"`
+	// X-API-Key: API key of the client, can also be sent as a bearer token
+	// in: header
+	XAPIKey string `json:"X-API-Key"`
+	// If-None-Match: ETags of the responses known by the client
+	// in: header
+	IfNoneMatch string `json:"If-None-Match"`
 	getFizzBuzzParams
 }
 
+// notModifiedResp the client already has the response
+//
+// swagger:response notModifiedResp
+// nolint
+type notModifiedResp struct {
+	// ETag of the response
+	// in: header
+	ETag string `json:"ETag"`
+	// Cache-Control
+	// in: header
+	CacheControl string `json:"Cache-Control"`
+}
+
 type getFizzBuzzParams struct {
 	// Number one
 	// in: query
@@ -85,62 +135,259 @@ type getFizzBuzzParams struct {
 // Responses:
 //    default: genericError
 //        200: getFizzBuzzResp
+//        304: notModifiedResp
 //        401: genericError
 //        404: genericError
 //        412: genericError
+//        429: genericError
+//        503: genericError
 //        500: genericError
 func (e *Endpoint) GetFizzBuzz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 	params := getFizzBuzzParams{}
-	if err := e.checkRequest(&params, r); err != nil {
+	_, span := e.startSpan(r.Context(), spanValidate)
+	err := e.checkRequest(&params, r)
+	tracing.SetError(span, err)
+	span.End()
+	if err != nil {
 		e.fail(http.StatusPreconditionFailed, err, w, r)
 		return
 	}
 
-	defer e.IncMetrics(params)
+	e.stats.Add(params.statsKey(), 1)
+	e.observeCost(w, r, params)
+
+	if e.setValidators(w, r, params) {
+		return
+	}
+
+	settle, ok := e.consume(w, r, params)
+	if !ok {
+		return
+	}
 
 	if e.xcache != nil && e.conf.Cache.Active {
-		cacheKey := fmt.Sprintf("%v", params)
-		item, err := e.xcache.Fetch(cacheKey, func() (interface{}, bool, error) {
-			ch := make(chan string, 1)
-			go e.convert(ch, params)
-			return e.formatEntireStringResp(ch, params.isJSON), true, nil
-		})
+		ctx, span := e.startSpan(r.Context(), spanFetch, attribute.String("cache.key", params.cacheKey()))
+		item, info, err := e.xcache.FetchInfo(params.cacheKey(), e.admitFetcher(routeLabel(r), params, e.fetcher(ctx, params)))
+		span.SetAttributes(
+			attribute.String("cache.status", string(info.Status)),
+			attribute.Bool("cache.hit", info.Status != xcache.StatusMiss),
+			attribute.Int("cache.age", int(info.Age.Seconds())))
+		tracing.SetError(span, err)
+		span.End()
+		w.Header().Set(CacheStatusHeaderKey, string(info.Status))
+		w.Header().Set("Age", strconv.Itoa(int(info.Age.Seconds())))
 
-		if err != nil {
-			e.log.Error("Fail to get cache", zap.Error(err))
+		settle(err)
+		if errors.Is(err, errShed) {
+			e.shed(w, r)
+			return
+		} else if err != nil {
+			logger.WithContext(r.Context()).Error("Fail to get cache", zap.Error(err))
 			e.fail(http.StatusInternalServerError, err, w, r)
+			return
 		}
 
-		resp, _ := item.([]byte)
-		if _, err := w.Write(resp); err != nil {
-			e.log.Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
-			e.fail(http.StatusInternalServerError, err, w, r)
-		}
+		seq, _ := item.([]byte)
+		e.renderResp(w, r, params, seq)
 		return
 	}
 
-	ch := make(chan string, 1)
-	go e.convert(ch, params)
-	e.formatResp(w, r, params, ch)
+	w.Header().Set(CacheStatusHeaderKey, CacheStatusBypass)
+	release, err := e.admit(r.Context(), routeLabel(r), params)
+	if err != nil {
+		settle(err)
+		e.shed(w, r)
+		return
+	}
+	defer release()
+	ctx, span := e.startSpan(r.Context(), spanRender, attribute.String("format", params.format()))
+	defer span.End()
+	ch, done := e.generate(ctx, params)
+	e.formatResp(w, r, params, ch, func() error {
+		err := done()
+		settle(err)
+		return err
+	})
+}
+
+// cacheKey returns the key of the sequence in xcache. The sequence is shared by all
+// the response formats, see renderResp().
+// It can be decoded with decodeParams() so that peers can compute it.
+func (p getFizzBuzzParams) cacheKey() string {
+	return p.canonical()
+}
+
+// statsKey returns the key used to count the most requested parameters.
+func (p getFizzBuzzParams) statsKey() string {
+	return p.canonical()
+}
+
+// canonical encodes the rule parameters as a query string with sorted fields and zero values
+// omitted, so that it doesn't depend on the order of the fields in the request nor on the
+// response format.
+func (p getFizzBuzzParams) canonical() string {
+	q := url.Values{}
+	if p.Limit != 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.NBOne != 0 {
+		q.Set("nbOne", strconv.Itoa(p.NBOne))
+	}
+	if p.NBTwo != 0 {
+		q.Set("nbTwo", strconv.Itoa(p.NBTwo))
+	}
+	if p.StrOne != "" {
+		q.Set("strOne", p.StrOne)
+	}
+	if p.StrTwo != "" {
+		q.Set("strTwo", p.StrTwo)
+	}
+	return q.Encode()
+}
+
+// compressedKey returns the key in xcache of the response for the given parameters,
+// rendered and compressed with encoding. See Cache.Compressed.
+func (p getFizzBuzzParams) compressedKey(encoding string) string {
+	return p.canonical() + "&" + url.Values{"format": {p.format()}, "encoding": {encoding}}.Encode()
+}
+
+// format returns the format of the response, formatJSON or formatText.
+func (p getFizzBuzzParams) format() string {
+	if p.isJSON {
+		return formatJSON
+	}
+	return formatText
+}
+
+// tags returns the xcache tags of the response for the given parameters.
+func (p getFizzBuzzParams) tags() []string {
+	var tags []string
+	if p.StrOne != "" {
+		tags = append(tags, WordTag(p.StrOne))
+	}
+	if p.StrTwo != "" && p.StrTwo != p.StrOne {
+		tags = append(tags, WordTag(p.StrTwo))
+	}
+	if p.NBOne != 0 {
+		tags = append(tags, NumberTag(p.NBOne))
+	}
+	if p.NBTwo != 0 && p.NBTwo != p.NBOne {
+		tags = append(tags, NumberTag(p.NBTwo))
+	}
+	return tags
+}
+
+// WordTag is the xcache tag of the responses using word as strOne or strTwo.
+func WordTag(word string) string {
+	return "word:" + word
+}
+
+// NumberTag is the xcache tag of the responses using nb as nbOne or nbTwo.
+func NumberTag(nb int) string {
+	return "nb:" + strconv.Itoa(nb)
+}
+
+// loadKey rebuilds the fetcher of a cache key asked by a peer. The peer requests aren't traced.
+// Keys that GetFizzBuzz wouldn't have built, such as non canonical ones, are rejected.
+func (e *Endpoint) loadKey(key string) (xcache.ResultFetcher, error) {
+	p, err := e.decodeParams(key)
+	if err != nil {
+		return nil, err
+	}
+	q, _ := url.ParseQuery(key)
+	if encoding := q.Get("encoding"); encoding != "" {
+		if !e.compresses(encoding) || p.compressedKey(encoding) != key {
+			return nil, fmt.Errorf("invalid cache key %q", key)
+		}
+		return e.compressedFetcher(context.Background(), p, encoding, nil), nil
+	}
+	if p.cacheKey() != key {
+		return nil, fmt.Errorf("invalid cache key %q", key)
+	}
+	return e.admitFetcher(xcache.PeersPath, p, e.fetcher(context.Background(), p)), nil
+}
+
+// compresses tells if the responses may be compressed with encoding.
+func (e *Endpoint) compresses(encoding string) bool {
+	if !e.conf.Compression.Active {
+		return false
+	}
+	for _, enc := range e.conf.Compression.Encodings {
+		if enc == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// fetcher returns the xcache.ResultFetcher computing the sequence for the given parameters.
+// The sequence is stored in its canonical form, the comma separated text response.
+// The generation is traced as a child of the span carried by ctx.
+func (e *Endpoint) fetcher(ctx context.Context, p getFizzBuzzParams) xcache.ResultFetcher {
+	return func() (xcache.Result, error) {
+		ch, done := e.generate(ctx, p)
+		seq := e.formatEntireStringResp(ch, false)
+		if err := done(); err != nil {
+			return xcache.Result{}, err
+		}
+		return xcache.Result{
+			Value: seq,
+			Valid: true,
+			Tags:  p.tags(),
+		}, nil
+	}
 }
 
-func (e *Endpoint) IncMetrics(p getFizzBuzzParams) {
-	e.metrics.ApiParamsCounter.WithLabelValues(strconv.Itoa(p.Limit), strconv.Itoa(p.NBOne), strconv.Itoa(p.NBTwo), p.StrOne, p.StrTwo).Inc()
+// compressedFetcher returns the xcache.ResultFetcher compressing with encoding the rendered
+// response body. If body is nil, the response is computed, without going through xcache.
+func (e *Endpoint) compressedFetcher(ctx context.Context, p getFizzBuzzParams, encoding string, body []byte) xcache.ResultFetcher {
+	return func() (xcache.Result, error) {
+		if e.compressor == nil {
+			return xcache.Result{}, fmt.Errorf("compression is disabled")
+		}
+		if body == nil {
+			res, err := e.fetcher(ctx, p)()
+			if err != nil {
+				return res, err
+			}
+			seq, _ := res.Value.([]byte)
+			if body, err = e.render(p, seq); err != nil {
+				return xcache.Result{}, err
+			}
+		}
+		compressed, err := e.compressor.Compress(encoding, body)
+		if err != nil {
+			return xcache.Result{}, err
+		}
+		return xcache.Result{
+			Value: compressed,
+			Valid: true,
+			Tags:  p.tags(),
+		}, nil
+	}
 }
 
 func (e *Endpoint) checkRequest(p *getFizzBuzzParams, r *http.Request) error {
-	var (
-		err error
-		q   url.Values = r.URL.Query()
-	)
+	if err := e.parseParams(p, r.URL.Query(), e.parameters(r)); err != nil {
+		return err
+	}
+
+	p.isJSON = strings.Index(r.Header.Get("Content-Type"), ContentTypeJSON) != -1
+
+	return nil
+}
+
+// parseParams reads the query parameters and validates them against the given limits.
+func (e *Endpoint) parseParams(p *getFizzBuzzParams, q url.Values, limits config.Parameters) error {
+	var err error
 
 	if q.Get("nbOne") != "" {
 		p.NBOne, err = strconv.Atoi(q.Get("nbOne"))
 		if err != nil {
 			return fmt.Errorf("invalid integer for p nbOne %s", q.Get("nbOne"))
 		}
-		if p.NBOne > e.conf.Parameters.MaxNb {
-			return fmt.Errorf("maximum size exceeded for p NBOne %s, max %d", q.Get("nbOne"), e.conf.Parameters.MaxNb)
+		if p.NBOne > limits.MaxNb {
+			return fmt.Errorf("maximum size exceeded for p NBOne %s, max %d", q.Get("nbOne"), limits.MaxNb)
 		}
 		if p.NBOne == 0 {
 			return fmt.Errorf("NBOne peter must be greater than zero")
@@ -152,8 +399,8 @@ func (e *Endpoint) checkRequest(p *getFizzBuzzParams, r *http.Request) error {
 		if err != nil {
 			return fmt.Errorf("invalid integer for p NBTwo %s", q.Get("nbTwo"))
 		}
-		if p.NBTwo > e.conf.Parameters.MaxNb {
-			return fmt.Errorf("maximum size exceeded for p NBTwo %s, max %d", q.Get("nbTwo"), e.conf.Parameters.MaxNb)
+		if p.NBTwo > limits.MaxNb {
+			return fmt.Errorf("maximum size exceeded for p NBTwo %s, max %d", q.Get("nbTwo"), limits.MaxNb)
 		}
 		if p.NBTwo == 0 {
 			return fmt.Errorf("NBTwo peter must be greater than zero")
@@ -168,23 +415,21 @@ func (e *Endpoint) checkRequest(p *getFizzBuzzParams, r *http.Request) error {
 		if p.Limit < 1 {
 			return fmt.Errorf("limit peter must be greater zero")
 		}
-		if p.Limit > e.conf.Parameters.MaxLimit {
-			return fmt.Errorf("maximum size exceeded for p limit %s, max %d", q.Get("limit"), e.conf.Parameters.MaxLimit)
+		if p.Limit > limits.MaxLimit {
+			return fmt.Errorf("maximum size exceeded for p limit %s, max %d", q.Get("limit"), limits.MaxLimit)
 		}
 	}
 
 	p.StrOne = q.Get("strOne")
-	if len(p.StrOne) > e.conf.Parameters.MaxStrChar {
-		return fmt.Errorf("maximum char exceeded %s, max %d", p.StrOne, e.conf.Parameters.MaxStrChar)
+	if len(p.StrOne) > limits.MaxStrChar {
+		return fmt.Errorf("maximum char exceeded %s, max %d", p.StrOne, limits.MaxStrChar)
 	}
 
 	p.StrTwo = q.Get("strTwo")
-	if len(p.StrTwo) > e.conf.Parameters.MaxStrChar {
-		return fmt.Errorf("maximum char exceeded %s, max %d", p.StrTwo, e.conf.Parameters.MaxStrChar)
+	if len(p.StrTwo) > limits.MaxStrChar {
+		return fmt.Errorf("maximum char exceeded %s, max %d", p.StrTwo, limits.MaxStrChar)
 	}
 
-	p.isJSON = strings.Index(r.Header.Get("Content-Type"), ContentTypeJSON) != -1
-
 	return nil
 }
 
@@ -193,8 +438,8 @@ func (e *Endpoint) checkRequest(p *getFizzBuzzParams, r *http.Request) error {
 // all multiples of int1 are replaced by str1,
 // all multiples of int2 are replaced by str2,
 // all multiples of int1 and int2 are replaced by str1str2.
-func (Endpoint) convert(ch chan string, p getFizzBuzzParams) {
-	defer close(ch)
+// The caller closes ch.
+func (*Endpoint) convert(ch chan string, p getFizzBuzzParams) {
 	if p.Limit == 0 {
 		ch <- ""
 		return
@@ -223,7 +468,25 @@ func (Endpoint) convert(ch chan string, p getFizzBuzzParams) {
 	return
 }
 
-func (m *Endpoint) formatResp(w http.ResponseWriter, r *http.Request, p getFizzBuzzParams, ch chan string) {
+// generate runs convert in a guarded goroutine. Once ch is drained, done tells whether the
+// sequence is complete: it returns an error if convert panicked.
+func (e *Endpoint) generate(ctx context.Context, p getFizzBuzzParams) (ch chan string, done func() error) {
+	ch = make(chan string, 1)
+	var err error
+	_, span := e.startSpan(ctx, spanGenerate, attribute.Int("limit", p.Limit))
+	go func() {
+		// closed once err is set, so that the reader of ch sees it
+		defer close(ch)
+		defer span.End()
+		e.guard(panicSourceConvert, func() { e.convert(ch, p) }, func(p interface{}) {
+			err = fmt.Errorf("fail to generate the sequence: %v", p)
+			tracing.SetError(span, err)
+		})
+	}()
+	return ch, func() error { return err }
+}
+
+func (m *Endpoint) formatResp(w http.ResponseWriter, r *http.Request, p getFizzBuzzParams, ch chan string, done func() error) {
 	var finalJsonStr string = ""
 	for {
 		if result, ok := <-ch; ok {
@@ -237,16 +500,25 @@ func (m *Endpoint) formatResp(w http.ResponseWriter, r *http.Request, p getFizzB
 		}
 	}
 
+	if err := done(); err != nil {
+		if !p.isJSON {
+			// the truncated text is already sent, abort the response
+			panic(http.ErrAbortHandler)
+		}
+		m.fail(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
 	if p.isJSON {
 		resp := JsonResp{
 			Txt: finalJsonStr,
 		}
 		if js, err := json.Marshal(resp); err != nil {
-			m.log.Error("Fail to json.Marshal", zap.Error(err))
+			logger.WithContext(r.Context()).Error("Fail to json.Marshal", zap.Error(err))
 			m.fail(http.StatusInternalServerError, err, w, r)
 
 		} else if _, err := w.Write(js); err != nil {
-			m.log.Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
+			logger.WithContext(r.Context()).Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
 			m.fail(http.StatusInternalServerError, err, w, r)
 		}
 	}
@@ -254,6 +526,61 @@ func (m *Endpoint) formatResp(w http.ResponseWriter, r *http.Request, p getFizzB
 	return
 }
 
+// render formats a sequence as asked by the client.
+func (m *Endpoint) render(p getFizzBuzzParams, seq []byte) ([]byte, error) {
+	if !p.isJSON {
+		return seq, nil
+	}
+	return json.Marshal(JsonResp{Txt: string(seq)})
+}
+
+// renderResp writes a cached sequence in the format asked by the client.
+func (m *Endpoint) renderResp(w http.ResponseWriter, r *http.Request, p getFizzBuzzParams, seq []byte) {
+	ctx, span := m.startSpan(r.Context(), spanRender, attribute.String("format", p.format()))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	resp, err := m.render(p, seq)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Fail to json.Marshal", zap.Error(err))
+		m.fail(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	if compressed, encoding, ok := m.compressedResp(r, p, resp); ok {
+		m.observeBodySize(r, encoding, len(resp), len(compressed))
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set(ETagHeaderKey, middle.EncodedETag(w.Header().Get(ETagHeaderKey), encoding))
+		resp = compressed
+	}
+
+	if _, err := w.Write(resp); err != nil {
+		logger.WithContext(r.Context()).Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
+		m.fail(http.StatusInternalServerError, err, w, r)
+	}
+}
+
+// compressedResp returns the response body compressed with the encoding accepted by the client.
+// The compressed body is kept in xcache, so that popular responses are only compressed once.
+// It returns false if Cache.Compressed is not set, or if the response must not be compressed:
+// the compression middleware then handles it.
+func (m *Endpoint) compressedResp(r *http.Request, p getFizzBuzzParams, body []byte) ([]byte, string, bool) {
+	if !m.conf.Cache.Compressed || m.compressor == nil || r.Method == http.MethodHead || len(body) < m.compressor.MinSize() {
+		return nil, "", false
+	}
+	encoding := m.compressor.Negotiate(r)
+	if encoding == middle.EncodingIdentity {
+		return nil, "", false
+	}
+	x, err := m.xcache.FetchResult(p.compressedKey(encoding), m.compressedFetcher(r.Context(), p, encoding, body))
+	if err != nil {
+		logger.WithContext(r.Context()).Warn("Fail to get compressed response", zap.String("encoding", encoding), zap.Error(err))
+		return nil, "", false
+	}
+	compressed, ok := x.([]byte)
+	return compressed, encoding, ok
+}
+
 func (m *Endpoint) formatEntireStringResp(ch chan string, isJson bool) []byte {
 	var finalJsonStr string = ""
 	for {
@@ -0,0 +1,56 @@
+package endpoint
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/ariden83/fizz-buzz/internal/catcher"
+	"github.com/ariden83/fizz-buzz/internal/xcache"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.uber.org/zap"
+)
+
+// sources of the panics
+const (
+	panicSourceHTTP    = "http"
+	panicSourceFetcher = "fetcher"
+	panicSourceConvert = "convert"
+	panicSourceWarmer  = "warmer"
+)
+
+// panicked logs and counts a panic recovered while serving a request.
+func (s *Endpoint) panicked(w http.ResponseWriter, r *http.Request, p interface{}, stack []byte) {
+	s.metrics.Panics.WithLabelValues(panicSourceHTTP).Inc()
+	logger.WithContext(r.Context()).Error("panic while serving a request",
+		zap.String("method", r.Method),
+		zap.String("url", r.URL.String()),
+		zap.Any("panic", p),
+		zap.ByteString("stack", stack))
+}
+
+// fetchPanicked logs and counts the panic of a fetcher of xcache.
+func (s *Endpoint) fetchPanicked(key string, err *xcache.PanicError) {
+	s.metrics.Panics.WithLabelValues(panicSourceFetcher).Inc()
+	s.log.Error("panic while fetching a cache entry",
+		zap.String("key", key),
+		zap.Any("panic", err.Value),
+		zap.ByteString("stack", err.Stack))
+}
+
+// guard runs f, logging and counting its panic if any, so that a background goroutine
+// doesn't crash the process. recovered, if not nil, is called with the panic.
+func (s *Endpoint) guard(source string, f func(), recovered func(p interface{})) {
+	catcher.Block{
+		Try: f,
+		Catch: func(e catcher.Exception) {
+			s.metrics.Panics.WithLabelValues(source).Inc()
+			s.log.Error("panic in background goroutine",
+				zap.String("source", source),
+				zap.Any("panic", e),
+				zap.ByteString("stack", debug.Stack()))
+			if recovered != nil {
+				recovered(e)
+			}
+		},
+	}.Do()
+}
@@ -0,0 +1,115 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	middle "github.com/ariden83/fizz-buzz/internal/middleware"
+	"github.com/ariden83/fizz-buzz/internal/tracing"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// log fields of the trace of a request
+const (
+	TraceIDKey = "trace_id"
+	SpanIDKey  = "span_id"
+)
+
+// instrumentationName is the name of the tracer of the endpoint.
+const instrumentationName = "github.com/ariden83/fizz-buzz/internal/endpoint"
+
+// names of the spans of a request
+const (
+	spanValidate = "validate"
+	spanFetch    = "xcache.Fetch"
+	spanGenerate = "generate"
+	spanRender   = "render"
+)
+
+// WithTracing traces the requests: the server span of a request continues the trace of the
+// traceparent header, and its operations are recorded as child spans. The spans are exported
+// to the OTLP/HTTP collector Tracing.Endpoint.
+func WithTracing() Option {
+	return func(s *Endpoint) error {
+		if !s.conf.Tracing.Active {
+			return nil
+		}
+		provider, err := tracing.NewProvider(s.conf.Tracing.Endpoint,
+			tracing.WithService(s.conf.Name, s.version),
+			tracing.WithSampleRatio(s.conf.Tracing.SampleRatio),
+			tracing.WithBatchSize(s.conf.Tracing.BatchSize),
+			tracing.WithFlushInterval(time.Duration(s.conf.Tracing.FlushInterval)*time.Millisecond),
+			tracing.WithTimeout(time.Duration(s.conf.Tracing.Timeout)*time.Millisecond))
+		if err != nil {
+			return fmt.Errorf("fail to set up tracing: %w", err)
+		}
+		s.tracerProvider = provider
+		s.tracer = provider.Tracer(instrumentationName)
+		return nil
+	}
+}
+
+// trace is a negroni middleware starting the server span of a request. The span is named
+// after the route template once the request is routed, and the trace IDs are added to the
+// log fields of the request.
+func (s *Endpoint) trace(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx := tracing.Extract(r.Context(), r.Header)
+	ctx, span := s.tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+			semconv.HTTPUserAgentKey.String(r.UserAgent()),
+			semconv.NetPeerIPKey.String(middle.ClientIP(r, s.conf.RateLimit.TrustedProxies))))
+	defer span.End()
+
+	sc := span.SpanContext()
+	logger.AddFields(ctx, zap.String(TraceIDKey, sc.TraceID().String()), zap.String(SpanIDKey, sc.SpanID().String()))
+	if traceresponse := tracing.Traceresponse(sc); traceresponse != "" {
+		w.Header().Set(tracing.TraceresponseHeaderKey, traceresponse)
+	}
+
+	res := negroni.NewResponseWriter(w)
+	r = r.WithContext(ctx)
+	next(res, r)
+
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if route := middle.Route(r); route != "" {
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRouteKey.String(route))
+	}
+	span.SetAttributes(
+		semconv.HTTPStatusCodeKey.Int(status),
+		semconv.HTTPResponseContentLengthKey.Int(res.Size()),
+		attribute.String("http.cache", res.Header().Get(CacheStatusHeaderKey)))
+	if status >= http.StatusInternalServerError {
+		tracing.SetError(span, fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+}
+
+// startSpan starts a child span of the request carried by ctx. The span is a no-op if tracing
+// is disabled.
+func (s *Endpoint) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if s.tracer == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// sampledTraceID returns the ID of the trace of ctx if it is recorded, for the exemplars.
+func sampledTraceID(ctx context.Context) (string, bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return "", false
+	}
+	return sc.TraceID().String(), true
+}
@@ -0,0 +1,130 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ariden83/fizz-buzz/internal/auth"
+	"github.com/ariden83/fizz-buzz/internal/usage"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.uber.org/zap"
+)
+
+// WithUsage counts the items served to the authenticated clients and enforces the quotas of
+// their tier. The counters are saved to Usage.StorePath if set.
+func WithUsage() Option {
+	return func(s *Endpoint) error {
+		if !s.conf.Usage.Active {
+			return nil
+		}
+		m, err := usage.New(usage.WithStore(s.conf.Usage.StorePath, time.Duration(s.conf.Usage.FlushInterval)*time.Second))
+		if err != nil {
+			return fmt.Errorf("fail to load usage store %s: %w", s.conf.Usage.StorePath, err)
+		}
+		s.usage = m
+		return nil
+	}
+}
+
+// usageResp is the consumption of a client
+type usageResp struct {
+	// ID of the API key
+	KeyID string `json:"key_id"`
+	// Tier of the API key
+	Tier string `json:"tier"`
+	usage.Report
+}
+
+// getUsageResp consumption of the client over the current day and month (UTC).
+// A quota of 0 is unlimited.
+//
+// swagger:response getUsageResp
+// nolint
+type getUsageResp struct {
+	// in: body
+	Body usageResp `json:"body"`
+}
+
+// getUsageReq Params for method GET
+//
+// swagger:parameters getUsageReq
+// nolint
+type getUsageReq struct {
+	// X-API-Key: API key of the client, can also be sent as a bearer token
+	// in: header
+	XAPIKey string `json:"X-API-Key"`
+}
+
+// quota returns the quotas of a tier.
+func quota(tier *auth.Tier) usage.Quota {
+	return usage.Quota{Daily: tier.DailyQuota, Monthly: tier.MonthlyQuota}
+}
+
+// consume counts the items of a response served to an authenticated client. It rejects the
+// request with a 429 and returns false if the items would exceed a quota of the client.
+// HEAD requests serve no item. The returned settle must be called with the error of the
+// response, if any: the items of a failed response are refunded.
+func (s *Endpoint) consume(w http.ResponseWriter, r *http.Request, p getFizzBuzzParams) (func(err error), bool) {
+	client, ok := auth.FromContext(r.Context())
+	if s.usage == nil || !ok || r.Method == http.MethodHead {
+		return func(error) {}, true
+	}
+
+	_, err := s.usage.Consume(client.KeyID, int64(p.Limit), quota(client.Tier))
+	var exceeded *usage.ExceededError
+	if errors.As(err, &exceeded) {
+		s.metrics.QuotaExceeded.WithLabelValues(client.Tier.Name, string(exceeded.Period)).Inc()
+		retry := time.Until(exceeded.Reset)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		s.fail(http.StatusTooManyRequests, err, w, r)
+		return nil, false
+	}
+	return func(err error) {
+		if err != nil {
+			s.usage.Refund(client.KeyID, int64(p.Limit))
+			return
+		}
+		s.metrics.UsageItems.WithLabelValues(client.Tier.Name).Add(float64(p.Limit))
+	}, true
+}
+
+// GetUsage swagger:route GET /usage usage getUsageReq
+//
+// Get the consumption of the client and the reset times of its quotas
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+// Responses:
+//    default: genericError
+//        200: getUsageResp
+//        401: genericError
+func (s *Endpoint) GetUsage(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	client, ok := auth.FromContext(r.Context())
+	if !ok {
+		s.unauthorized(w, r, fmt.Errorf("missing API key"))
+		return
+	}
+
+	resp := usageResp{
+		KeyID:  client.KeyID,
+		Tier:   client.Tier.Name,
+		Report: s.usage.Usage(client.KeyID, quota(client.Tier)),
+	}
+	js, err := json.Marshal(resp)
+	if err != nil {
+		s.fail(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.Header().Set(CacheControlHeaderKey, "no-store")
+	if _, err := w.Write(js); err != nil {
+		logger.WithContext(r.Context()).Error("Fail to Write response in http.ResponseWriter", zap.Error(err))
+	}
+}
@@ -0,0 +1,174 @@
+package endpoint
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	warmSourceConfig = "config"
+	warmSourceStats  = "stats"
+
+	warmResultWarmed  = "warmed"
+	warmResultSkipped = "skipped"
+	warmResultFailed  = "failed"
+	warmResultInvalid = "invalid"
+)
+
+// warmJob is a set of parameters to precompute into xcache.
+type warmJob struct {
+	params getFizzBuzzParams
+	source string
+}
+
+// WithWarmer precomputes into xcache the parameter sets listed in the configuration
+// and the most requested ones, at startup and then every Cache.WarmInterval seconds.
+// It must be passed after WithXCache().
+func WithWarmer() Option {
+	return func(s *Endpoint) error {
+		if s.xcache == nil || !s.conf.Cache.Active {
+			return nil
+		}
+		s.stopWarm = make(chan struct{})
+		go s.guard(panicSourceWarmer, s.warmLoop, nil)
+		return nil
+	}
+}
+
+// warmLoop runs the warm-up until the endpoint is shut down.
+func (s *Endpoint) warmLoop() {
+	s.warm()
+	if s.conf.Cache.WarmInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(s.conf.Cache.WarmInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.warm()
+		case <-s.stopWarm:
+			return
+		}
+	}
+}
+
+// warm runs a single warm-up with at most Cache.WarmConcurrency concurrent fetches.
+// xcache.Warm() never waits for a fetcher, so live requests keep their priority.
+func (s *Endpoint) warm() {
+	start := time.Now()
+	jobs := s.warmJobs()
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		results = map[string]int{}
+		queue   = make(chan warmJob)
+	)
+
+	workers := s.conf.Cache.WarmConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				result := s.warmOne(job)
+				lock.Lock()
+				results[result]++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	// no job is queued once stopped, select picking randomly among the ready cases
+feed:
+	for _, job := range jobs {
+		select {
+		case <-s.stopWarm:
+			break feed
+		default:
+		}
+		select {
+		case queue <- job:
+		case <-s.stopWarm:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	duration := time.Since(start)
+	s.metrics.CacheWarmLastRun.Set(duration.Seconds())
+	s.log.Info("cache warm-up done",
+		zap.Int("sets", len(jobs)),
+		zap.Int(warmResultWarmed, results[warmResultWarmed]),
+		zap.Int(warmResultSkipped, results[warmResultSkipped]),
+		zap.Int(warmResultFailed, results[warmResultFailed]),
+		zap.Duration("duration", duration))
+}
+
+// warmOne precomputes a single set of parameters and returns the result of the operation.
+func (s *Endpoint) warmOne(job warmJob) string {
+	result := warmResultSkipped
+	warmed, err := s.xcache.Warm(job.params.cacheKey(), s.fetcher(context.Background(), job.params))
+	if err != nil {
+		result = warmResultFailed
+		s.log.Warn("fail to warm cache entry", zap.String("params", job.params.statsKey()), zap.Error(err))
+	} else if warmed {
+		result = warmResultWarmed
+	}
+	s.metrics.ObserveCacheWarm(job.source, result)
+	s.log.Debug("cache entry warm-up", zap.String("params", job.params.statsKey()),
+		zap.String("source", job.source), zap.String("result", result))
+	return result
+}
+
+// warmJobs lists the sets to warm: first the ones from the configuration, then the Cache.WarmTopN most requested ones.
+func (s *Endpoint) warmJobs() []warmJob {
+	var jobs []warmJob
+
+	for _, set := range s.conf.Cache.WarmSets {
+		p, err := s.decodeParams(set)
+		if err != nil {
+			s.metrics.ObserveCacheWarm(warmSourceConfig, warmResultInvalid)
+			s.log.Warn("invalid cache warm-up set", zap.String("set", set), zap.Error(err))
+			continue
+		}
+		jobs = append(jobs, warmJob{params: p, source: warmSourceConfig})
+	}
+
+	if s.conf.Cache.WarmTopN <= 0 {
+		return jobs
+	}
+	for _, entry := range s.stats.Top(s.conf.Cache.WarmTopN) {
+		p, err := s.decodeParams(entry.Key)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, warmJob{params: p, source: warmSourceStats})
+	}
+	return jobs
+}
+
+// decodeParams decodes a set of parameters given as a query string, see canonical()
+// and compressedKey().
+func (s *Endpoint) decodeParams(set string) (getFizzBuzzParams, error) {
+	p := getFizzBuzzParams{}
+	q, err := url.ParseQuery(set)
+	if err != nil {
+		return p, err
+	}
+	if err := s.parseParams(&p, q, s.widestParameters()); err != nil {
+		return p, err
+	}
+	p.isJSON = q.Get("format") == formatJSON
+	return p, nil
+}
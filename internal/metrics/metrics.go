@@ -1,25 +1,96 @@
 package metrics
 
 import (
+	"net/http"
+	"runtime"
+	"time"
+
 	"github.com/ariden83/fizz-buzz/config"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
+// namespace prefixes the names of the Prometheus metrics.
+const namespace = "fizzbuzz_api"
+
 type Metrics struct {
 	RouteCountReqs   *prometheus.CounterVec
 	InFlight         prometheus.Gauge
 	ResponseDuration *prometheus.HistogramVec
 	RequestSize      *prometheus.SummaryVec
 	ResponseSize     *prometheus.SummaryVec
-	ApiParamsCounter *prometheus.CounterVec
+	ResponseBodySize *prometheus.SummaryVec
+	ApiParams        *TopKCollector
+	CacheWarm        *prometheus.CounterVec
+	CacheWarmLastRun prometheus.Gauge
+	RateLimited      *prometheus.CounterVec
+	RequestCost      *prometheus.HistogramVec
+	AdmissionInUse   prometheus.Gauge
+	AdmissionShed    *prometheus.CounterVec
+	AuthRequests     *prometheus.CounterVec
+	UsageItems       *prometheus.CounterVec
+	QuotaExceeded    *prometheus.CounterVec
+	Panics           *prometheus.CounterVec
+	BuildInfo        *prometheus.GaugeVec
 	log              *zap.Logger
 	conf             *config.Config
+
+	// Registerer and Gatherer are the registry of the metrics, private to the instance
+	// unless WithRegistry is passed.
+	Registerer prometheus.Registerer
+	Gatherer   prometheus.Gatherer
+	version    string
+	logStats   LogStats
+
+	sinks []Sink // Prometheus first, then the mirrors
+}
+
+// Option is the type of option passed to New.
+type Option func(m *Metrics)
+
+// WithRegistry registers the metrics on reg and serves the metrics gathered by gatherer,
+// to share a registry with other components. Two Metrics can't share a registry.
+// Default: a new prometheus.Registry
+func WithRegistry(reg prometheus.Registerer, gatherer prometheus.Gatherer) Option {
+	return func(m *Metrics) {
+		m.Registerer = reg
+		m.Gatherer = gatherer
+	}
+}
+
+// WithSink mirrors the measures to s, closed by Close.
+// Default: a StatsD sink if Metrics.StatsDActive is set
+func WithSink(s Sink) Option {
+	return func(m *Metrics) {
+		m.sinks = append(m.sinks, s)
+	}
+}
+
+// LogStats counts the messages sent to Graylog, such as *logger.Stats.
+type LogStats interface {
+	Sent() uint64
+	Dropped() uint64
+	Failed() uint64
 }
 
-func New(c *config.Config, log *zap.Logger) *Metrics {
-	namespace := "fizzbuzz_api"
+// WithLogStats exports the counters of the messages sent to Graylog.
+// Default: nil, not exported
+func WithLogStats(s LogStats) Option {
+	return func(m *Metrics) {
+		m.logStats = s
+	}
+}
+
+// WithVersion sets the version label of the build info.
+// Default: ""
+func WithVersion(version string) Option {
+	return func(m *Metrics) {
+		m.version = version
+	}
+}
+
+func New(c *config.Config, log *zap.Logger, opts ...Option) *Metrics {
 	metric := &Metrics{
 		log:  log,
 		conf: c,
@@ -28,32 +99,43 @@ func New(c *config.Config, log *zap.Logger) *Metrics {
 			prometheus.CounterOpts{
 				Name:        "http_requests_total",
 				Namespace:   namespace,
-				Help:        "How many HTTP requests processed, partitioned by status code, method and HTTP path.",
+				Help:        "How many HTTP requests processed, partitioned by method, route template, status class and cache status.",
 				ConstLabels: prometheus.Labels{"app": c.Name},
 			},
-			[]string{"code", "service"},
+			[]string{"method", "route", "status", "cache"},
 		),
 
-		RequestSize: promauto.NewSummaryVec(
+		RequestSize: prometheus.NewSummaryVec(
 			prometheus.SummaryOpts{
 				Name:        "http_push_size_bytes",
 				Namespace:   namespace,
-				Help:        "HTTP request size",
+				Help:        "HTTP request size, partitioned by method, route template and status class.",
 				Objectives:  map[float64]float64{0.1: 0.01, 0.5: 0.05, 0.9: 0.01},
 				ConstLabels: prometheus.Labels{"app": c.Name},
 			},
-			[]string{"service"},
+			[]string{"method", "route", "status"},
 		),
 
-		ResponseSize: promauto.NewSummaryVec(
+		ResponseSize: prometheus.NewSummaryVec(
 			prometheus.SummaryOpts{
 				Name:        "http_response_size_bytes",
 				Namespace:   namespace,
-				Help:        "HTTP response size",
+				Help:        "HTTP response size on the wire, partitioned by method, route template and status class.",
 				Objectives:  map[float64]float64{0.1: 0.01, 0.5: 0.05, 0.9: 0.01},
 				ConstLabels: prometheus.Labels{"app": c.Name},
 			},
-			[]string{"service"},
+			[]string{"method", "route", "status"},
+		),
+
+		ResponseBodySize: prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:        "http_response_body_size_bytes",
+				Namespace:   namespace,
+				Help:        "HTTP response body size before (raw) and after (wire) compression, partitioned by route template and content coding.",
+				Objectives:  map[float64]float64{0.1: 0.01, 0.5: 0.05, 0.9: 0.01},
+				ConstLabels: prometheus.Labels{"app": c.Name},
+			},
+			[]string{"route", "encoding", "size"},
 		),
 
 		ResponseDuration: prometheus.NewHistogramVec(
@@ -61,11 +143,11 @@ func New(c *config.Config, log *zap.Logger) *Metrics {
 				Namespace:   namespace,
 				Subsystem:   "http_request",
 				Name:        "duration_seconds",
-				Help:        "Run duration for each route",
+				Help:        "Run duration, partitioned by method, route template, status class and cache status.",
 				Buckets:     prometheus.ExponentialBuckets(0.01, 2, 25),
 				ConstLabels: prometheus.Labels{"app": c.Name},
 			},
-			[]string{"service", "code"},
+			[]string{"method", "route", "status", "cache"},
 		),
 
 		InFlight: prometheus.NewGauge(
@@ -75,16 +157,185 @@ func New(c *config.Config, log *zap.Logger) *Metrics {
 				Help:      "Number of HTTP requests currently processed",
 			}),
 
-		ApiParamsCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "count_params",
-			Help:      "count the different paths used",
-		}, []string{"limit", "nbOne", "nbTwo", "strOne", "strTwo"}),
+		ApiParams: NewTopKCollector(prometheus.Opts{
+			Namespace:   namespace,
+			Name:        "params_top_requests_total",
+			Help:        "Estimated count of the most requested parameter sets, partitioned by rank.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, "params", c.Metrics.ParamsTopK),
+
+		CacheWarm: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "cache_warm",
+			Name:        "entries_total",
+			Help:        "How many cache entries the warmer processed, partitioned by source and result.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"source", "result"}),
+
+		CacheWarmLastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "cache_warm",
+			Name:        "last_run_duration_seconds",
+			Help:        "Duration of the last cache warm-up run",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}),
+
+		RateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "rate_limit",
+			Name:        "rejections_total",
+			Help:        "How many HTTP requests were rejected by the rate limiter, partitioned by method and kind of client key.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"method", "by"}),
+
+		RequestCost: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "admission",
+			Name:        "request_cost",
+			Help:        "Estimated cost of the HTTP requests, in KB of response, partitioned by route template.",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 12),
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"route"}),
+
+		AdmissionInUse: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "admission",
+			Name:        "cost_in_use",
+			Help:        "Cost of the HTTP requests currently processed",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}),
+
+		AdmissionShed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "admission",
+			Name:        "shed_total",
+			Help:        "How many HTTP requests were shed because the cost budget was exceeded, partitioned by route template.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"route"}),
+
+		AuthRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "auth",
+			Name:        "requests_total",
+			Help:        "How many HTTP requests were authenticated, partitioned by API key (jwt for the JWTs), tier and result.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"key_id", "tier", "result"}),
+
+		UsageItems: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "usage",
+			Name:        "items_total",
+			Help:        "How many items were served to the authenticated clients, partitioned by tier.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"tier"}),
+
+		QuotaExceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "usage",
+			Name:        "quota_exceeded_total",
+			Help:        "How many HTTP requests were rejected because a quota was exceeded, partitioned by tier and period.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"tier", "period"}),
+
+		Panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "panics_total",
+			Help:        "How many panics were recovered, partitioned by source (http, fetcher, convert, warmer).",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"source"}),
+
+		BuildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "build_info",
+			Help:        "A metric with a constant '1' value labelled by the version of the service and of Go.",
+			ConstLabels: prometheus.Labels{"app": c.Name},
+		}, []string{"version", "goversion"}),
 	}
 
-	prometheus.MustRegister(metric.RouteCountReqs)
-	prometheus.MustRegister(metric.InFlight)
-	prometheus.MustRegister(metric.ResponseDuration)
-	prometheus.MustRegister(metric.ApiParamsCounter)
+	metric.sinks = []Sink{prometheusSink{m: metric}}
+	if c.Metrics.StatsDActive {
+		statsd, err := NewStatsD(c.Metrics.StatsDAddr,
+			WithPrefix(c.Metrics.StatsDPrefix),
+			WithFlavor(c.Metrics.StatsDFlavor),
+			WithTags(c.Metrics.StatsDTags...),
+			WithSampleRate(c.Metrics.StatsDSampleRate),
+			WithMaxPacketSize(c.Metrics.StatsDMaxPacketSize),
+			WithStatsDFlushInterval(time.Duration(c.Metrics.StatsDFlushInterval)*time.Millisecond),
+			WithStatsDErrorHandler(func(err error) {
+				log.Warn("fail to send statsd metrics", zap.String("addr", c.Metrics.StatsDAddr), zap.Error(err))
+			}))
+		if err != nil {
+			log.Error("fail to init statsd sink", zap.String("addr", c.Metrics.StatsDAddr), zap.Error(err))
+		} else {
+			metric.sinks = append(metric.sinks, statsd)
+		}
+	}
+
+	for _, o := range opts {
+		o(metric)
+	}
+	if metric.Registerer == nil {
+		reg := prometheus.NewRegistry()
+		metric.Registerer, metric.Gatherer = reg, reg
+	}
+	metric.BuildInfo.WithLabelValues(metric.version, runtime.Version()).Set(1)
+
+	metric.Registerer.MustRegister(metric.RouteCountReqs)
+	metric.Registerer.MustRegister(metric.InFlight)
+	metric.Registerer.MustRegister(metric.ResponseDuration)
+	metric.Registerer.MustRegister(metric.RequestSize)
+	metric.Registerer.MustRegister(metric.ResponseSize)
+	metric.Registerer.MustRegister(metric.ResponseBodySize)
+	metric.Registerer.MustRegister(metric.ApiParams)
+	metric.Registerer.MustRegister(metric.CacheWarm)
+	metric.Registerer.MustRegister(metric.CacheWarmLastRun)
+	metric.Registerer.MustRegister(metric.RateLimited)
+	metric.Registerer.MustRegister(metric.RequestCost)
+	metric.Registerer.MustRegister(metric.AdmissionInUse)
+	metric.Registerer.MustRegister(metric.AdmissionShed)
+	metric.Registerer.MustRegister(metric.AuthRequests)
+	metric.Registerer.MustRegister(metric.UsageItems)
+	metric.Registerer.MustRegister(metric.QuotaExceeded)
+	metric.Registerer.MustRegister(metric.Panics)
+	metric.Registerer.MustRegister(metric.BuildInfo)
+	if metric.logStats != nil {
+		for result, count := range map[string]func() uint64{
+			"sent":    metric.logStats.Sent,
+			"dropped": metric.logStats.Dropped,
+			"failed":  metric.logStats.Failed,
+		} {
+			count := count
+			metric.Registerer.MustRegister(prometheus.NewCounterFunc(
+				prometheus.CounterOpts{
+					Name:        "gelf_messages_total",
+					Namespace:   namespace,
+					Help:        "How many log messages processed by the Graylog writer, partitioned by result.",
+					ConstLabels: prometheus.Labels{"app": c.Name, "result": result},
+				},
+				func() float64 { return float64(count()) },
+			))
+		}
+	}
+
+	// the default registry has some of them already, a private one must be given them all
+	metric.registerRuntime(prometheus.NewGoCollector())
+	metric.registerRuntime(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	metric.registerRuntime(prometheus.NewBuildInfoCollector())
 	return metric
 }
+
+// registerRuntime registers a collector of the process, unless the registry has one already.
+func (m *Metrics) registerRuntime(c prometheus.Collector) {
+	if err := m.Registerer.Register(c); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			panic(err)
+		}
+	}
+}
+
+// Handler serves the metrics of the registry, with the OpenMetrics format if the scraper
+// accepts it so that the exemplars are exposed.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(m.Registerer,
+		promhttp.HandlerFor(m.Gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+}
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Request is the measure of a served HTTP request.
+type Request struct {
+	Method       string
+	Route        string // route template
+	Status       string // status class, such as "2xx"
+	Cache        string // cache status
+	Duration     time.Duration
+	RequestSize  int
+	ResponseSize int
+	TraceID      string // ID of the trace of the request if it is recorded, "" otherwise
+}
+
+// Sink receives the measures of the service. Prometheus is always a sink, the other ones mirror
+// a subset of its metrics to other monitoring systems.
+type Sink interface {
+	// ObserveRequest measures a served HTTP request.
+	ObserveRequest(r Request)
+	// ObserveCacheWarm counts an entry processed by the cache warmer.
+	ObserveCacheWarm(source, result string)
+	// ObserveCacheStats exports the counters of the cache, read when the measures are collected.
+	ObserveCacheStats(c CacheStats)
+	// Close flushes the pending measures.
+	Close() error
+}
+
+// ObserveRequest measures a served HTTP request in every sink.
+func (m *Metrics) ObserveRequest(r Request) {
+	for _, s := range m.sinks {
+		s.ObserveRequest(r)
+	}
+}
+
+// ObserveCacheWarm counts an entry processed by the cache warmer in every sink.
+func (m *Metrics) ObserveCacheWarm(source, result string) {
+	for _, s := range m.sinks {
+		s.ObserveCacheWarm(source, result)
+	}
+}
+
+// CacheStats counts the operations of a cache since start, such as *xcache.Cache.
+type CacheStats interface {
+	Requests() uint64
+	Hits() uint64
+	NewFetches() uint64
+	StaleFetches() uint64
+	EarlyFetches() uint64
+	WarmFetches() uint64
+	BackendHits() uint64
+	BackendErrors() uint64
+	PeerHits() uint64
+	PeerErrors() uint64
+}
+
+// cacheCounter is a counter of CacheStats, named after its event.
+type cacheCounter struct {
+	event string
+	count func() uint64
+}
+
+func cacheCounters(c CacheStats) []cacheCounter {
+	return []cacheCounter{
+		{"requests", c.Requests},
+		{"hits", c.Hits},
+		{"new_fetches", c.NewFetches},
+		{"stale_fetches", c.StaleFetches},
+		{"early_fetches", c.EarlyFetches},
+		{"warm_fetches", c.WarmFetches},
+		{"backend_hits", c.BackendHits},
+		{"backend_errors", c.BackendErrors},
+		{"peer_hits", c.PeerHits},
+		{"peer_errors", c.PeerErrors},
+	}
+}
+
+// ObserveCacheStats exports the counters of the cache in every sink. It must be called once.
+func (m *Metrics) ObserveCacheStats(c CacheStats) {
+	for _, s := range m.sinks {
+		s.ObserveCacheStats(c)
+	}
+}
+
+// Close flushes the pending measures of the sinks.
+func (m *Metrics) Close() error {
+	var err error
+	for _, s := range m.sinks {
+		if e := s.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// prometheusSink records the measures in the Prometheus metrics.
+type prometheusSink struct {
+	m *Metrics
+}
+
+func (p prometheusSink) ObserveRequest(r Request) {
+	p.m.RouteCountReqs.WithLabelValues(r.Method, r.Route, r.Status, r.Cache).Inc()
+	p.m.RequestSize.WithLabelValues(r.Method, r.Route, r.Status).Observe(float64(r.RequestSize))
+	p.m.ResponseSize.WithLabelValues(r.Method, r.Route, r.Status).Observe(float64(r.ResponseSize))
+
+	duration := p.m.ResponseDuration.WithLabelValues(r.Method, r.Route, r.Status, r.Cache)
+	if r.TraceID != "" {
+		// links the latency buckets to a trace, exposed with the OpenMetrics format
+		duration.(prometheus.ExemplarObserver).ObserveWithExemplar(r.Duration.Seconds(), prometheus.Labels{"trace_id": r.TraceID})
+		return
+	}
+	duration.Observe(r.Duration.Seconds())
+}
+
+func (p prometheusSink) ObserveCacheWarm(source, result string) {
+	p.m.CacheWarm.WithLabelValues(source, result).Inc()
+}
+
+func (p prometheusSink) ObserveCacheStats(c CacheStats) {
+	for _, counter := range cacheCounters(c) {
+		count := counter.count
+		p.m.Registerer.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name:        "xcache_events_total",
+				Namespace:   namespace,
+				Help:        "How many events counted by the cache since start, partitioned by event.",
+				ConstLabels: prometheus.Labels{"app": p.m.conf.Name, "event": counter.event},
+			},
+			func() float64 { return float64(count()) },
+		))
+	}
+}
+
+func (p prometheusSink) Close() error {
+	return nil
+}
@@ -0,0 +1,291 @@
+package metrics
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flavors of the StatsD protocol
+const (
+	// FlavorStatsD is the original protocol, without tags: the tags are dropped.
+	FlavorStatsD = "statsd"
+	// FlavorDogStatsD is the DogStatsD extension, with tags and histograms.
+	FlavorDogStatsD = "dogstatsd"
+)
+
+// StatsD is a Sink sending the measures to a StatsD or DogStatsD agent over UDP. The lines
+// are batched into packets of at most the max packet size, sent when full and every flush
+// interval, so that a request doesn't cost a syscall.
+type StatsD struct {
+	conn       net.Conn
+	prefix     string
+	flavor     string
+	tags       []string
+	sampleRate float64
+	maxPacket  int
+	interval   time.Duration
+	onError    func(error)
+
+	lock      sync.Mutex // guard access to "buf", "random", "cache" and "cacheSent"
+	buf       bytes.Buffer
+	random    *rand.Rand
+	cache     []cacheCounter
+	cacheSent []uint64 // values of the cache counters last sent
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// StatsDOption is the type of option passed to NewStatsD.
+type StatsDOption func(*StatsD)
+
+// WithPrefix sets the prefix of the metric names, such as "fizzbuzz_api.".
+// Default: ""
+func WithPrefix(prefix string) StatsDOption {
+	return func(s *StatsD) {
+		s.prefix = prefix
+	}
+}
+
+// WithFlavor sets the protocol, FlavorStatsD or FlavorDogStatsD.
+// Default: FlavorDogStatsD
+func WithFlavor(flavor string) StatsDOption {
+	return func(s *StatsD) {
+		s.flavor = flavor
+	}
+}
+
+// WithTags sets the tags added to every measure, such as "env:prod".
+// Default: none
+func WithTags(tags ...string) StatsDOption {
+	return func(s *StatsD) {
+		s.tags = tags
+	}
+}
+
+// WithSampleRate sets the ratio of the counters and timings sent, the agent scaling them back.
+// Default: 1
+func WithSampleRate(rate float64) StatsDOption {
+	return func(s *StatsD) {
+		if rate > 0 && rate <= 1 {
+			s.sampleRate = rate
+		}
+	}
+}
+
+// WithMaxPacketSize sets the maximum size of a UDP packet. The default fits in the MTU of an
+// Ethernet network; 8932 fits in the jumbo frames.
+// Default: 1432
+func WithMaxPacketSize(size int) StatsDOption {
+	return func(s *StatsD) {
+		if size > 0 {
+			s.maxPacket = size
+		}
+	}
+}
+
+// WithStatsDFlushInterval sets the maximum time a measure waits in the buffer.
+// Default: 1s
+func WithStatsDFlushInterval(d time.Duration) StatsDOption {
+	return func(s *StatsD) {
+		if d > 0 {
+			s.interval = d
+		}
+	}
+}
+
+// WithStatsDErrorHandler sets the function notified of the failed sends.
+// Default: nil
+func WithStatsDErrorHandler(f func(error)) StatsDOption {
+	return func(s *StatsD) {
+		s.onError = f
+	}
+}
+
+// NewStatsD builds a sink sending the measures to the agent listening on the UDP address addr.
+func NewStatsD(addr string, opts ...StatsDOption) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		conn:       conn,
+		flavor:     FlavorDogStatsD,
+		sampleRate: 1,
+		maxPacket:  1432,
+		interval:   time.Second,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	go s.run()
+	return s, nil
+}
+
+// ObserveRequest implements Sink.
+func (s *StatsD) ObserveRequest(r Request) {
+	tags := []string{"method:" + r.Method, "route:" + r.Route, "status:" + r.Status, "cache:" + r.Cache}
+	s.Count("http.requests", 1, tags...)
+	s.Timing("http.request.duration", r.Duration, tags...)
+	tags = tags[:3]
+	s.Histogram("http.request.size", float64(r.RequestSize), tags...)
+	s.Histogram("http.response.size", float64(r.ResponseSize), tags...)
+	if r.Cache != "" {
+		s.Count("cache.requests", 1, "status:"+r.Cache)
+	}
+}
+
+// ObserveCacheWarm implements Sink.
+func (s *StatsD) ObserveCacheWarm(source, result string) {
+	s.Count("cache.warm", 1, "source:"+source, "result:"+result)
+}
+
+// ObserveCacheStats implements Sink: the counters of the cache are sent every flush interval,
+// as counts of the events since the previous send.
+func (s *StatsD) ObserveCacheStats(c CacheStats) {
+	s.lock.Lock()
+	s.cache = cacheCounters(c)
+	s.cacheSent = make([]uint64, len(s.cache))
+	s.lock.Unlock()
+}
+
+// sendCacheStats sends the counters of the cache which increased since the previous send.
+// They are never sampled, since the agent couldn't scale them back.
+func (s *StatsD) sendCacheStats() {
+	s.lock.Lock()
+	counters := s.cache
+	counts := make([]uint64, len(counters))
+	for i, c := range counters {
+		n := c.count()
+		counts[i] = n - s.cacheSent[i]
+		s.cacheSent[i] = n
+	}
+	s.lock.Unlock()
+
+	for i, c := range counters {
+		if counts[i] > 0 {
+			s.send("xcache."+c.event, strconv.FormatUint(counts[i], 10), "c", false, nil)
+		}
+	}
+}
+
+// Count adds n to a counter.
+func (s *StatsD) Count(name string, n int64, tags ...string) {
+	s.send(name, strconv.FormatInt(n, 10), "c", true, tags)
+}
+
+// Timing records a duration, in milliseconds.
+func (s *StatsD) Timing(name string, d time.Duration, tags ...string) {
+	s.send(name, strconv.FormatFloat(d.Seconds()*1000, 'f', -1, 64), "ms", true, tags)
+}
+
+// Histogram records a value in a distribution. The original protocol has no histogram, the
+// value is then sent as a timing, which the agents aggregate the same way.
+func (s *StatsD) Histogram(name string, value float64, tags ...string) {
+	typ := "h"
+	if s.flavor == FlavorStatsD {
+		typ = "ms"
+	}
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), typ, true, tags)
+}
+
+// Gauge sets a gauge. Gauges are never sampled.
+func (s *StatsD) Gauge(name string, value float64, tags ...string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", false, tags)
+}
+
+// send formats a line and appends it to the packet being built.
+func (s *StatsD) send(name, value, typ string, sampled bool, tags []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if sampled && s.sampleRate < 1 && s.random.Float64() >= s.sampleRate {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(s.prefix)
+	line.WriteString(name)
+	line.WriteByte(':')
+	line.WriteString(value)
+	line.WriteByte('|')
+	line.WriteString(typ)
+	if sampled && s.sampleRate < 1 {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(s.sampleRate, 'f', -1, 64))
+	}
+	if s.flavor == FlavorDogStatsD && len(s.tags)+len(tags) > 0 {
+		line.WriteString("|#")
+		all := append(append(make([]string, 0, len(s.tags)+len(tags)), s.tags...), tags...)
+		line.WriteString(tagReplacer.Replace(strings.Join(all, ",")))
+	}
+
+	// a line longer than a packet is sent alone
+	if s.buf.Len() > 0 && s.buf.Len()+1+line.Len() > s.maxPacket {
+		s.flushLocked()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line.String())
+}
+
+// tagReplacer replaces in the tags the characters having a meaning in the DogStatsD protocol,
+// the commas separating them excepted.
+var tagReplacer = strings.NewReplacer("|", "_", "#", "_", "\n", "_")
+
+// Flush sends the buffered measures.
+func (s *StatsD) Flush() {
+	s.lock.Lock()
+	s.flushLocked()
+	s.lock.Unlock()
+}
+
+func (s *StatsD) flushLocked() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil && s.onError != nil {
+		s.onError(err)
+	}
+	s.buf.Reset()
+}
+
+// run flushes the buffer every flush interval.
+func (s *StatsD) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sendCacheStats()
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close implements Sink: it sends the buffered measures and closes the connection. Only the
+// first call has an effect.
+func (s *StatsD) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.sendCacheStats()
+		s.Flush()
+		s.closeErr = s.conn.Close()
+	})
+	return s.closeErr
+}
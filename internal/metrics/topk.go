@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/ariden83/fizz-buzz/internal/topk"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TopKCollector exports the most frequent keys of a topk.TopK. Each scrape exposes at most k
+// series, one per rank, labelled with the key having this rank: the cardinality is bounded
+// whatever the keys sent by the clients.
+type TopKCollector struct {
+	k     int
+	count *prometheus.Desc
+	error *prometheus.Desc
+	lock  sync.RWMutex // guard access to "top"
+	top   *topk.TopK
+}
+
+// NewTopKCollector builds a collector of the k most frequent keys, named after opts. The
+// key label is named keyLabel. It exports nothing until Watch is called.
+func NewTopKCollector(opts prometheus.Opts, keyLabel string, k int) *TopKCollector {
+	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	labels := []string{"rank", keyLabel}
+	return &TopKCollector{
+		k:     k,
+		count: prometheus.NewDesc(name, opts.Help, labels, opts.ConstLabels),
+		error: prometheus.NewDesc(name+"_error", "Maximum over-estimation of "+name+".", labels, opts.ConstLabels),
+	}
+}
+
+// Watch sets the counters to export.
+func (c *TopKCollector) Watch(top *topk.TopK) {
+	c.lock.Lock()
+	c.top = top
+	c.lock.Unlock()
+}
+
+// Describe implements prometheus.Collector.
+func (c *TopKCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.count
+	ch <- c.error
+}
+
+// Collect implements prometheus.Collector.
+func (c *TopKCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.RLock()
+	top := c.top
+	c.lock.RUnlock()
+	if top == nil {
+		return
+	}
+
+	for i, e := range top.Top(c.k) {
+		rank := strconv.Itoa(i + 1)
+		ch <- prometheus.MustNewConstMetric(c.count, prometheus.CounterValue, float64(e.Count), rank, e.Key)
+		ch <- prometheus.MustNewConstMetric(c.error, prometheus.GaugeValue, float64(e.Error), rank, e.Key)
+	}
+}
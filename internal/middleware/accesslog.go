@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"github.com/urfave/negroni"
+	"go.uber.org/zap"
+)
+
+// AccessLog is a negroni middleware writing one structured line per request, with the logger
+// of the request context (see logger.ToContext) so that it carries the request ID and the
+// fields added while serving the request.
+type AccessLog struct {
+	trustedProxies int
+}
+
+// AccessLogOption is the type of option passed to NewAccessLog.
+type AccessLogOption func(*AccessLog)
+
+// WithTrustedProxies sets the number of proxies in front of the server, to log the client IP.
+// Default: 0
+func WithTrustedProxies(n int) AccessLogOption {
+	return func(a *AccessLog) {
+		a.trustedProxies = n
+	}
+}
+
+// NewAccessLog builds an access log middleware.
+func NewAccessLog(opts ...AccessLogOption) *AccessLog {
+	a := &AccessLog{}
+	for _, o := range opts {
+		o(a)
+	}
+	return a
+}
+
+// ServeHTTP implements negroni.Handler.
+func (a *AccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	res, ok := w.(negroni.ResponseWriter)
+	if !ok {
+		res = negroni.NewResponseWriter(w)
+	}
+	r = r.WithContext(TrackRoute(r.Context()))
+	next(res, r)
+
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	logger.WithContext(r.Context()).Info("access",
+		zap.String("method", r.Method),
+		zap.String("route", Route(r)),
+		zap.String("path", r.URL.Path),
+		zap.Int("status", status),
+		zap.Int("bytes", res.Size()),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("cache", res.Header().Get("X-Cache")),
+		zap.String("client", ClientIP(r, a.trustedProxies)),
+		zap.String("user_agent", r.UserAgent()))
+}
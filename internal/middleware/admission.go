@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// CostLimiter bounds the total cost of the requests processed concurrently.
+//
+// A request is admitted as soon as its cost fits in the remaining budget, even if more
+// expensive requests are waiting: cheap requests keep flowing while expensive ones queue.
+// Requests waiting longer than the queue timeout are shed.
+type CostLimiter struct {
+	budget  int64
+	timeout time.Duration
+
+	lock    sync.Mutex
+	inUse   int64
+	waiters *list.List // of *costWaiter, by arrival order
+}
+
+// costWaiter is a request waiting for its cost to fit in the budget.
+type costWaiter struct {
+	cost  int64
+	ready chan struct{} // closed once admitted
+}
+
+// NewCostLimiter builds a limiter admitting requests up to budget cost units concurrently,
+// and queuing them at most timeout.
+func NewCostLimiter(budget int64, timeout time.Duration) *CostLimiter {
+	if budget < 1 {
+		budget = 1
+	}
+	return &CostLimiter{
+		budget:  budget,
+		timeout: timeout,
+		waiters: list.New(),
+	}
+}
+
+// Acquire admits a request of the given cost, waiting for the budget at most the queue timeout.
+// A request costing more than the whole budget is admitted alone.
+// It returns the cost to give back to Release(), or false if the request must be shed.
+func (l *CostLimiter) Acquire(ctx context.Context, cost int64) (int64, bool) {
+	if cost > l.budget {
+		cost = l.budget
+	}
+	if cost < 1 {
+		cost = 1
+	}
+
+	l.lock.Lock()
+	if l.inUse+cost <= l.budget {
+		l.inUse += cost
+		l.lock.Unlock()
+		return cost, true
+	}
+	if l.timeout <= 0 {
+		l.lock.Unlock()
+		return cost, false
+	}
+	w := &costWaiter{cost: cost, ready: make(chan struct{})}
+	e := l.waiters.PushBack(w)
+	l.lock.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return cost, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-w.ready:
+		// admitted meanwhile
+		return cost, true
+	default:
+	}
+	l.waiters.Remove(e)
+	return cost, false
+}
+
+// Release gives back the cost of a request admitted by Acquire(), and admits the waiting
+// requests which now fit in the budget.
+func (l *CostLimiter) Release(cost int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.inUse -= cost
+	for e := l.waiters.Front(); e != nil && l.inUse < l.budget; {
+		next := e.Next()
+		w := e.Value.(*costWaiter)
+		if l.inUse+w.cost <= l.budget {
+			l.inUse += w.cost
+			l.waiters.Remove(e)
+			close(w.ready)
+		}
+		e = next
+	}
+}
+
+// InUse returns the cost of the requests currently admitted.
+func (l *CostLimiter) InUse() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inUse
+}
+
+// Waiting returns the number of requests queued.
+func (l *CostLimiter) Waiting() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.waiters.Len()
+}
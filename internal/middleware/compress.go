@@ -0,0 +1,405 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings supported by the Compressor.
+const (
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
+)
+
+// SizeObserver receives the size of a response body before (raw) and after (wire) compression.
+// The encoding is EncodingIdentity if the response was sent uncompressed.
+type SizeObserver func(r *http.Request, encoding string, raw, wire int)
+
+// Compressor is a negroni middleware compressing the responses with the content coding
+// negotiated from the Accept-Encoding header of the request.
+// Responses smaller than the minimum size, without body, or already encoded by the handler
+// are sent as is.
+type Compressor struct {
+	minSize   int
+	encodings []string
+	observe   SizeObserver
+	pools     map[string]*sync.Pool
+}
+
+// CompressOption is the type of option passed to NewCompressor.
+type CompressOption func(*Compressor)
+
+// WithMinSize sets the size under which responses are not compressed.
+// Default: 1024
+func WithMinSize(n int) CompressOption {
+	return func(c *Compressor) {
+		c.minSize = n
+	}
+}
+
+// WithEncodings sets the supported content codings, by order of preference.
+// Unknown codings are ignored.
+// Default: zstd, gzip, deflate
+func WithEncodings(encodings ...string) CompressOption {
+	return func(c *Compressor) {
+		c.encodings = nil
+		for _, e := range encodings {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if e == EncodingZstd || e == EncodingGzip || e == EncodingDeflate {
+				c.encodings = append(c.encodings, e)
+			}
+		}
+	}
+}
+
+// WithSizeObserver sets the function receiving the raw and wire size of the responses.
+// Default: nil
+func WithSizeObserver(f SizeObserver) CompressOption {
+	return func(c *Compressor) {
+		c.observe = f
+	}
+}
+
+// NewCompressor builds a compression middleware.
+func NewCompressor(opts ...CompressOption) *Compressor {
+	c := &Compressor{
+		minSize:   1024,
+		encodings: []string{EncodingZstd, EncodingGzip, EncodingDeflate},
+		pools:     make(map[string]*sync.Pool),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	for _, e := range c.encodings {
+		e := e
+		c.pools[e] = &sync.Pool{New: func() interface{} {
+			w, _ := newEncoder(e, io.Discard)
+			return w
+		}}
+	}
+	return c
+}
+
+// MinSize returns the size under which responses are not compressed.
+func (c *Compressor) MinSize() int {
+	return c.minSize
+}
+
+// Negotiate returns the content coding to use for a request, or EncodingIdentity.
+func (c *Compressor) Negotiate(r *http.Request) string {
+	return negotiate(r.Header.Get("Accept-Encoding"), c.encodings)
+}
+
+// Compress encodes b with the given content coding.
+func (c *Compressor) Compress(encoding string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := c.encoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(b); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	c.release(encoding, enc)
+	return buf.Bytes(), nil
+}
+
+// ServeHTTP implements negroni.Handler.
+func (c *Compressor) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := c.Negotiate(r)
+	if encoding == EncodingIdentity || r.Method == http.MethodHead {
+		cw := &countingWriter{ResponseWriter: w}
+		next(cw, r)
+		if c.observe != nil && w.Header().Get("Content-Encoding") == "" {
+			c.observe(r, EncodingIdentity, cw.n, cw.n)
+		}
+		return
+	}
+
+	// the ETag of a compressed response differs from the uncompressed one,
+	// so the handler must compare the conditional headers with the uncompressed ETag
+	cw := &compressWriter{ResponseWriter: w, c: c, encoding: encoding}
+	inm := r.Header.Get("If-None-Match")
+	if stripped := StripETagEncoding(inm, encoding); stripped != inm {
+		r.Header.Set("If-None-Match", stripped)
+		cw.stripped = true
+	}
+
+	next(cw, r)
+	if err := cw.close(); err != nil {
+		return
+	}
+	if c.observe != nil && !cw.preEncoded {
+		c.observe(r, cw.usedEncoding(), cw.raw, cw.wire.n)
+	}
+}
+
+// EncodedETag returns the ETag of a response compressed with encoding.
+// Weak ETags are left unchanged.
+func EncodedETag(etag, encoding string) string {
+	if encoding == EncodingIdentity || len(etag) < 2 || !strings.HasPrefix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// StripETagEncoding removes the encoding suffix added by EncodedETag from the tags of
+// an If-None-Match or If-Match header.
+func StripETagEncoding(header, encoding string) string {
+	suffix := "-" + encoding + `"`
+	if !strings.Contains(header, suffix) {
+		return header
+	}
+	return strings.Replace(header, suffix, `"`, -1)
+}
+
+// negotiate chooses among the supported encodings the one preferred by the client,
+// following the quality values of the Accept-Encoding header. Ties are broken by the
+// order of the supported encodings.
+func negotiate(header string, supported []string) string {
+	if header == "" {
+		return EncodingIdentity
+	}
+	quality := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		quality[name] = q
+	}
+
+	best, bestQ := EncodingIdentity, 0.0
+	for _, e := range supported {
+		q, ok := quality[e]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// encoder returns a pooled encoder writing to w.
+func (c *Compressor) encoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	pool, ok := c.pools[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	switch enc := pool.Get().(type) {
+	case *gzip.Writer:
+		enc.Reset(w)
+		return enc, nil
+	case *zlib.Writer:
+		enc.Reset(w)
+		return enc, nil
+	case *zstd.Encoder:
+		enc.Reset(w)
+		return enc, nil
+	}
+	return newEncoder(encoding, w)
+}
+
+// release puts back an encoder into its pool once closed.
+func (c *Compressor) release(encoding string, enc io.WriteCloser) {
+	if pool, ok := c.pools[encoding]; ok {
+		pool.Put(enc)
+	}
+}
+
+// newEncoder builds an encoder writing to w.
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingDeflate:
+		// the "deflate" content coding is the zlib format (RFC 1950)
+		return zlib.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// countingWriter counts the bytes written to a http.ResponseWriter.
+type countingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += n
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// compressWriter buffers the beginning of a response until it knows whether it must
+// be compressed, then streams it through the encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	c          *Compressor
+	encoding   string
+	status     int
+	buf        []byte
+	raw        int
+	wire       countingWriter
+	enc        io.WriteCloser
+	started    bool // headers sent
+	preEncoded bool // the handler set its own Content-Encoding
+	stripped   bool // the client sent the ETag of the compressed response
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	w.raw += len(b)
+	if w.started {
+		return w.write(b)
+	}
+	if !w.compressible() {
+		w.start(false)
+		return w.write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.c.minSize {
+		if err := w.flushBuffer(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *compressWriter) Flush() {
+	if !w.started {
+		_ = w.flushBuffer(w.compressible() && len(w.buf) >= w.c.minSize)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	w.wire.Flush()
+}
+
+// compressible tells if the response may be compressed, given its status and headers.
+func (w *compressWriter) compressible() bool {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		w.preEncoded = true
+		return false
+	}
+	return !strings.Contains(w.Header().Get("Cache-Control"), "no-transform")
+}
+
+// start sends the headers, announcing the compression if any.
+func (w *compressWriter) start(compress bool) {
+	w.started = true
+	w.wire.ResponseWriter = w.ResponseWriter
+	h := w.Header()
+	if compress {
+		if h.Get("Content-Type") == "" {
+			// sniffed from the uncompressed bytes, as net/http would do
+			h.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", EncodedETag(etag, w.encoding))
+		}
+		w.enc, _ = w.c.encoder(w.encoding, &w.wire)
+	} else if w.status == http.StatusNotModified && w.stripped {
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", EncodedETag(etag, w.encoding))
+		}
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// flushBuffer starts the response and writes the buffered bytes.
+func (w *compressWriter) flushBuffer(compress bool) error {
+	w.start(compress)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.write(buf)
+	return err
+}
+
+func (w *compressWriter) write(b []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.wire.Write(b)
+}
+
+// close ends the response, sending the buffered bytes uncompressed if they are too few.
+func (w *compressWriter) close() error {
+	if !w.started {
+		if err := w.flushBuffer(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.c.release(w.encoding, w.enc)
+	w.enc = nil
+	return err
+}
+
+// usedEncoding returns the content coding of the response sent.
+func (w *compressWriter) usedEncoding() string {
+	if w.Header().Get("Content-Encoding") == w.encoding {
+		return w.encoding
+	}
+	return EncodingIdentity
+}
@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is a negroni middleware implementing Cross-Origin Resource Sharing. It answers the
+// preflight requests itself, and adds the CORS headers to the actual requests of the
+// allowed origins.
+type CORS struct {
+	origins     []string // exact origins, or patterns with one '*'
+	anyOrigin   bool
+	methods     []string
+	headers     []string
+	anyHeader   bool
+	exposed     []string
+	credentials bool
+	maxAge      time.Duration
+}
+
+// CORSOption is the type of option passed to NewCORS.
+type CORSOption func(*CORS)
+
+// WithAllowedOrigins sets the origins allowed to call the API: exact origins such as
+// "https://app.example.com", patterns with a wildcard such as "https://*.example.com",
+// or "*" for any origin.
+// Default: "*"
+func WithAllowedOrigins(origins ...string) CORSOption {
+	return func(c *CORS) {
+		c.origins, c.anyOrigin = nil, false
+		for _, o := range origins {
+			o = strings.ToLower(strings.TrimSpace(o))
+			if o == "*" {
+				c.anyOrigin = true
+			} else if o != "" {
+				c.origins = append(c.origins, o)
+			}
+		}
+	}
+}
+
+// WithAllowedMethods sets the methods allowed in the requests.
+// Default: GET, HEAD, OPTIONS
+func WithAllowedMethods(methods ...string) CORSOption {
+	return func(c *CORS) {
+		c.methods = nil
+		for _, m := range methods {
+			if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+				c.methods = append(c.methods, m)
+			}
+		}
+	}
+}
+
+// WithAllowedHeaders sets the request headers allowed in the requests, "*" for any header.
+// Default: Content-Type
+func WithAllowedHeaders(headers ...string) CORSOption {
+	return func(c *CORS) {
+		c.headers, c.anyHeader = nil, false
+		for _, h := range headers {
+			h = strings.TrimSpace(h)
+			if h == "*" {
+				c.anyHeader = true
+			} else if h != "" {
+				c.headers = append(c.headers, http.CanonicalHeaderKey(h))
+			}
+		}
+	}
+}
+
+// WithExposedHeaders sets the response headers readable by the scripts of the allowed origins.
+// Default: none
+func WithExposedHeaders(headers ...string) CORSOption {
+	return func(c *CORS) {
+		c.exposed = nil
+		for _, h := range headers {
+			if h = strings.TrimSpace(h); h != "" {
+				c.exposed = append(c.exposed, http.CanonicalHeaderKey(h))
+			}
+		}
+	}
+}
+
+// WithCredentials allows the requests with credentials (cookies, Authorization header).
+// The allowed origin is then always echoed, even if any origin is allowed.
+// Default: false
+func WithCredentials(allow bool) CORSOption {
+	return func(c *CORS) {
+		c.credentials = allow
+	}
+}
+
+// WithMaxAge sets how long the browsers may cache the result of a preflight request.
+// Default: 0 (not set)
+func WithMaxAge(d time.Duration) CORSOption {
+	return func(c *CORS) {
+		c.maxAge = d
+	}
+}
+
+// NewCORS builds a CORS middleware.
+func NewCORS(opts ...CORSOption) *CORS {
+	c := &CORS{
+		anyOrigin: true,
+		methods:   []string{http.MethodGet, http.MethodHead, http.MethodOptions},
+		headers:   []string{"Content-Type"},
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// ServeHTTP implements negroni.Handler.
+func (c *CORS) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	h := w.Header()
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	if !c.anyOrigin || c.credentials {
+		// the response depends on the origin
+		h.Add("Vary", "Origin")
+	}
+	if origin == "" {
+		next(w, r)
+		return
+	}
+
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !c.allowOrigin(origin) || !c.allowMethod(r.Header.Get("Access-Control-Request-Method")) ||
+			!c.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		c.setOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+		if c.anyHeader {
+			// echo the requested headers, "*" isn't a wildcard with credentials
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+		} else if len(c.headers) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+		}
+		if c.maxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if c.allowOrigin(origin) {
+		c.setOrigin(h, origin)
+		if len(c.exposed) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.exposed, ", "))
+		}
+	}
+	next(w, r)
+}
+
+// setOrigin sets the allowed origin of a response, and whether credentials are allowed.
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin && !c.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// allowOrigin tells if origin matches one of the allowed origins.
+func (c *CORS) allowOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, o := range c.origins {
+		if matchOrigin(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin tells if origin matches pattern, where a '*' stands for at least one character.
+func matchOrigin(pattern, origin string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == origin
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(origin) > len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
+
+// allowMethod tells if method is allowed.
+func (c *CORS) allowMethod(method string) bool {
+	method = strings.ToUpper(method)
+	for _, m := range c.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders tells if all the headers of a comma separated list are allowed.
+func (c *CORS) allowHeaders(requested string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		allowed := false
+		for _, h := range c.headers {
+			if strings.EqualFold(h, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
@@ -2,18 +2,33 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 )
 
 // DefaultHeader for set default header
 func DefaultHeader(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS, HEAD")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Accept-ranges", "items")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	now := time.Now()
-	w.Header().Set("Date", now.String())
+	// RFC 7231 IMF-fixdate, always in GMT
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
 
 	next(w, r)
 }
+
+// SecurityHeader returns a middleware setting the security headers of the responses:
+// Strict-Transport-Security for hstsMaxAge (unless 0) and X-Content-Type-Options.
+// Browsers ignore Strict-Transport-Security over plain HTTP.
+func SecurityHeader(hstsMaxAge time.Duration) func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	hsts := ""
+	if hstsMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds())) + "; includeSubDomains"
+	}
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		next(w, r)
+	}
+}
@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is the rate of a token bucket: Rate tokens are added per second, up to Burst.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// KeyFunc returns the key of the bucket of a request, and the limit of that bucket.
+type KeyFunc func(r *http.Request) (string, Limit)
+
+// RejectFunc writes the response of a request over its limit. The rate limit headers
+// are already set.
+type RejectFunc func(w http.ResponseWriter, r *http.Request, key string)
+
+// RateLimiter is a negroni middleware limiting the requests of each client with a token bucket.
+// Buckets are kept in memory, the least recently used ones being evicted beyond the maximum size.
+type RateLimiter struct {
+	keyFunc KeyFunc
+	reject  RejectFunc
+	size    int
+
+	lock    sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List // of *bucket, most recently used first
+}
+
+// bucket is the token bucket of a client.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitOption is the type of option passed to NewRateLimiter.
+type RateLimitOption func(*RateLimiter)
+
+// WithKeyFunc sets the function choosing the bucket of a request.
+// Default: the client IP (see ClientIP) with a limit of 10 requests per second, burst 100
+func WithKeyFunc(f KeyFunc) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.keyFunc = f
+	}
+}
+
+// WithRejectFunc sets the function writing the response of the rejected requests.
+// Default: an empty 429 response
+func WithRejectFunc(f RejectFunc) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.reject = f
+	}
+}
+
+// WithBuckets sets the maximum number of buckets kept in memory.
+// Default: 10000
+func WithBuckets(n int) RateLimitOption {
+	return func(l *RateLimiter) {
+		if n > 0 {
+			l.size = n
+		}
+	}
+}
+
+// NewRateLimiter builds a rate limiting middleware.
+func NewRateLimiter(opts ...RateLimitOption) *RateLimiter {
+	l := &RateLimiter{
+		keyFunc: func(r *http.Request) (string, Limit) {
+			return ClientIP(r, 0), Limit{Rate: 10, Burst: 100}
+		},
+		reject: func(w http.ResponseWriter, _ *http.Request, _ string) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		size:    10000,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+// ServeHTTP implements negroni.Handler.
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key, limit := l.keyFunc(r)
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		// unlimited
+		next(w, r)
+		return
+	}
+
+	allowed, remaining, retryAfter := l.take(key, limit)
+
+	// see draft-ietf-httpapi-ratelimit-headers
+	window := int(math.Ceil(float64(limit.Burst) / limit.Rate))
+	reset := int(math.Ceil(float64(limit.Burst-remaining) / limit.Rate))
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(reset))
+	h.Set("RateLimit-Policy", strconv.Itoa(limit.Burst)+";w="+strconv.Itoa(window))
+
+	if !allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		l.reject(w, r, key)
+		return
+	}
+	next(w, r)
+}
+
+// Len returns the number of buckets in memory.
+func (l *RateLimiter) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.lru.Len()
+}
+
+// take consumes a token from the bucket of key. It returns whether the request is allowed,
+// the number of tokens left, and when a token will be available if none is.
+func (l *RateLimiter) take(key string, limit Limit) (bool, int, time.Duration) {
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		for l.lru.Len() > l.size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// ClientIP returns the IP of the client of a request. Behind trustedProxies reverse proxies,
+// each one appending the address of its client to X-Forwarded-For, the client IP is the
+// trustedProxies-th address from the end of that header; otherwise it is the remote address.
+func ClientIP(r *http.Request, trustedProxies int) string {
+	if trustedProxies > 0 {
+		var ips []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(header, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		if len(ips) > 0 {
+			i := len(ips) - trustedProxies
+			if i < 0 {
+				i = 0
+			}
+			return ips[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/ariden83/fizz-buzz/internal/catcher"
+)
+
+// ContentTypeProblem is the media type of the problem details of RFC 7807.
+const ContentTypeProblem = "application/problem+json"
+
+// Problem is a problem details object (RFC 7807).
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// WriteProblem writes a problem details response. The validators of the response are removed,
+// it must not be cached.
+func WriteProblem(w http.ResponseWriter, status int, detail, instance string) {
+	h := w.Header()
+	h.Del("ETag")
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(status)
+
+	js, _ := json.Marshal(Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: instance,
+	})
+	_, _ = w.Write(js)
+}
+
+// PanicFunc is called with the value and the stack of a panic recovered while serving a request.
+type PanicFunc func(w http.ResponseWriter, r *http.Request, p interface{}, stack []byte)
+
+// Recovery is a negroni middleware turning the panics of the next handlers into 500 problem
+// responses. If the response was already started, the connection is aborted instead so that
+// the client doesn't take a truncated response for a complete one.
+type Recovery struct {
+	onPanic PanicFunc
+}
+
+// RecoveryOption is the type of option passed to NewRecovery.
+type RecoveryOption func(*Recovery)
+
+// WithPanicFunc sets the function notified of the panics, to log or count them.
+// Default: nil
+func WithPanicFunc(f PanicFunc) RecoveryOption {
+	return func(rec *Recovery) {
+		rec.onPanic = f
+	}
+}
+
+// NewRecovery builds a panic recovery middleware.
+func NewRecovery(opts ...RecoveryOption) *Recovery {
+	rec := &Recovery{}
+	for _, o := range opts {
+		o(rec)
+	}
+	return rec
+}
+
+// ServeHTTP implements negroni.Handler.
+func (rec *Recovery) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	catcher.Block{
+		Try: func() {
+			next(w, r)
+		},
+		Catch: func(e catcher.Exception) {
+			if e == http.ErrAbortHandler {
+				// deliberate abort, see net/http
+				panic(e)
+			}
+			if rec.onPanic != nil {
+				rec.onPanic(w, r, e, debug.Stack())
+			}
+			if written, ok := w.(interface{ Written() bool }); ok && written.Written() {
+				panic(http.ErrAbortHandler)
+			}
+			WriteProblem(w, http.StatusInternalServerError, "internal error", r.URL.Path)
+		},
+	}.Do()
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+type routeKey struct{}
+
+// routeHolder receives the route template of a request once it is routed.
+type routeHolder struct {
+	route string
+}
+
+// TrackRoute returns a copy of ctx in which the router can record the route template of
+// the request, for the middlewares running before the router (see SetRoute and Route).
+func TrackRoute(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, routeKey{}, &routeHolder{})
+}
+
+// SetRoute records the route template of a request, such as "/fizz-buzz".
+func SetRoute(r *http.Request, route string) {
+	if h, ok := r.Context().Value(routeKey{}).(*routeHolder); ok {
+		h.route = route
+	}
+}
+
+// Route returns the route template recorded for a request, or "" if it wasn't routed.
+func Route(r *http.Request) string {
+	if h, ok := r.Context().Value(routeKey{}).(*routeHolder); ok {
+		return h.route
+	}
+	return ""
+}
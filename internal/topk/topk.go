@@ -0,0 +1,127 @@
+// Package topk keeps track of the most frequent keys of a stream in bounded memory.
+// It implements the Space-Saving algorithm (Metwally et al.): at most "capacity" keys
+// are counted, and a new key replaces the least frequent one, inheriting its count
+// as an over-estimation error.
+package topk
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// Entry is a counted key.
+type Entry struct {
+	Key   string
+	Count uint64 // estimated count, never under-estimated
+	Error uint64 // maximum over-estimation of Count
+}
+
+// TopK is a Space-Saving counter, safe for concurrent use.
+type TopK struct {
+	capacity int
+	index    map[string]*counter // counters by key
+	heap     counterHeap         // counters ordered by count, least frequent first
+	lock     sync.Mutex          // guard access to "index" and "heap"
+}
+
+// counter is an Entry stored in the heap.
+type counter struct {
+	Entry
+	pos int // position in the heap
+}
+
+// New builds a TopK counting at most capacity keys.
+func New(capacity int) *TopK {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TopK{
+		capacity: capacity,
+		index:    make(map[string]*counter, capacity),
+		heap:     make(counterHeap, 0, capacity),
+	}
+}
+
+// Add increments the count of key by n.
+func (t *TopK) Add(key string, n uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if c, ok := t.index[key]; ok {
+		c.Count += n
+		heap.Fix(&t.heap, c.pos)
+		return
+	}
+
+	if len(t.heap) < t.capacity {
+		c := &counter{Entry: Entry{Key: key, Count: n}}
+		t.index[key] = c
+		heap.Push(&t.heap, c)
+		return
+	}
+
+	// replace the least frequent key
+	c := t.heap[0]
+	delete(t.index, c.Key)
+	c.Key = key
+	c.Error = c.Count
+	c.Count += n
+	t.index[key] = c
+	heap.Fix(&t.heap, 0)
+}
+
+// Top returns the n most frequent keys, most frequent first.
+// If n <= 0, all the counted keys are returned.
+func (t *TopK) Top(n int) []Entry {
+	t.lock.Lock()
+	entries := make([]Entry, 0, len(t.heap))
+	for _, c := range t.heap {
+		entries = append(entries, c.Entry)
+	}
+	t.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count == entries[j].Count {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Count > entries[j].Count
+	})
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Len returns the number of counted keys.
+func (t *TopK) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.heap)
+}
+
+// counterHeap implements heap.Interface.
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*counter)
+	c.pos = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[:n-1]
+	return c
+}
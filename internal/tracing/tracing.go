@@ -0,0 +1,163 @@
+// Package tracing sets up the OpenTelemetry tracing of the service: the spans are sampled by
+// trace ID ratio unless the caller decided, batched, and exported to a collector over
+// OTLP/HTTP. The W3C Trace Context (traceparent and tracestate headers) is propagated.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceresponseHeaderKey returns to the client the context of the server span
+	// (W3C Trace Context Level 2).
+	TraceresponseHeaderKey = "traceresponse"
+
+	traceparentHeaderKey = "traceparent"
+)
+
+// Propagator reads and writes the W3C Trace Context of the requests.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// config is the configuration of a provider.
+type config struct {
+	service       string
+	version       string
+	ratio         float64
+	batchSize     int
+	flushInterval time.Duration
+	timeout       time.Duration
+}
+
+// Option is the type of option passed to NewProvider.
+type Option func(*config)
+
+// WithService sets the service.name and service.version resource attributes of the spans.
+// Default: "unknown_service", ""
+func WithService(name, version string) Option {
+	return func(c *config) {
+		c.service = name
+		c.version = version
+	}
+}
+
+// WithSampleRatio sets the ratio of the traces started here which are recorded. The traces
+// continued from a request follow the sampling decision of the caller.
+// Default: 1
+func WithSampleRatio(ratio float64) Option {
+	return func(c *config) {
+		c.ratio = ratio
+	}
+}
+
+// WithBatchSize sets the maximum number of spans of a request to the collector.
+// Default: 512
+func WithBatchSize(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.batchSize = n
+		}
+	}
+}
+
+// WithFlushInterval sets the maximum time a span waits before being exported.
+// Default: 1s
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.flushInterval = d
+		}
+	}
+}
+
+// WithTimeout sets the timeout of the requests to the collector.
+// Default: 5s
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// NewProvider builds a tracer provider exporting the spans to endpoint, the URL of the traces
+// of a collector (http://host:4318/v1/traces). The export errors are sent to the handler set
+// by otel.SetErrorHandler. The provider must be shut down to export the last spans.
+func NewProvider(endpoint string, opts ...Option) (*sdktrace.TracerProvider, error) {
+	cfg := config{
+		service:       "unknown_service",
+		ratio:         1,
+		batchSize:     512,
+		flushInterval: time.Second,
+		timeout:       5 * time.Second,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	exporterOpts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+		otlptracehttp.WithTimeout(cfg.timeout),
+	}
+	if u.Scheme == "http" {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), exporterOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(cfg.service),
+		semconv.ServiceVersionKey.String(cfg.version)))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.ratio))),
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxExportBatchSize(cfg.batchSize),
+			sdktrace.WithBatchTimeout(cfg.flushInterval),
+			sdktrace.WithExportTimeout(cfg.timeout)),
+	), nil
+}
+
+// Extract returns a copy of ctx carrying the span context of the headers of a request, if any.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return Propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// Traceresponse formats the traceresponse header of a span context, same format as traceparent.
+// It returns "" if the span context is not valid.
+func Traceresponse(sc trace.SpanContext) string {
+	h := http.Header{}
+	Propagator.Inject(trace.ContextWithSpanContext(context.Background(), sc), propagation.HeaderCarrier(h))
+	return h.Get(traceparentHeaderKey)
+}
+
+// SetError records err on the span and marks the operation as failed. A nil err does nothing.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,301 @@
+// Package usage counts the items served to each API client per day and per month, and
+// enforces their quotas. Periods are calendar days and months in UTC.
+//
+// Counters are kept in memory and, if a store path is set, periodically written to a
+// JSON file which is loaded back on startup, so that restarts don't reset the quotas.
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Period is a quota period.
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// Quota is the number of items a client may be served per period. Zero values are unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// Counter is the consumption of a client over a period.
+type Counter struct {
+	Used  int64     `json:"used"`
+	Quota int64     `json:"quota"` // 0 if unlimited
+	Reset time.Time `json:"reset"`
+}
+
+// Report is the consumption of a client over the current periods.
+type Report struct {
+	Daily   Counter `json:"daily"`
+	Monthly Counter `json:"monthly"`
+}
+
+// ExceededError is returned by Meter.Consume when serving the items would exceed a quota.
+type ExceededError struct {
+	Period Period
+	Quota  int64
+	Reset  time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota of %d items exceeded, reset at %s", e.Period, e.Quota, e.Reset.Format(time.RFC3339))
+}
+
+// record is the stored consumption of a client, for the day and the month it was last updated.
+type record struct {
+	Day     string `json:"day"`
+	Daily   int64  `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int64  `json:"monthly"`
+}
+
+// roll resets the counters of the periods which ended before now.
+func (r *record) roll(now time.Time) {
+	if day := now.Format(dayLayout); r.Day != day {
+		r.Day, r.Daily = day, 0
+	}
+	if month := now.Format(monthLayout); r.Month != month {
+		r.Month, r.Monthly = month, 0
+	}
+}
+
+// Meter counts the items served to the clients.
+type Meter struct {
+	path     string
+	interval time.Duration
+
+	lock    sync.Mutex
+	records map[string]*record
+	dirty   bool
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Option is the type of option passed to New.
+type Option func(*Meter)
+
+// WithStore saves the counters to the file at path every interval, and loads them on startup.
+// Default: "" (memory only)
+func WithStore(path string, interval time.Duration) Option {
+	return func(m *Meter) {
+		m.path = path
+		m.interval = interval
+	}
+}
+
+// New builds a Meter, loading the counters of its store if any. A missing store is not an error.
+func New(opts ...Option) (*Meter, error) {
+	m := &Meter{
+		records: make(map[string]*record),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(m)
+	}
+
+	if m.path != "" {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+	if m.path != "" && m.interval > 0 {
+		go m.flusher()
+	} else {
+		close(m.done)
+	}
+	return m, nil
+}
+
+// Consume counts n items served to key, unless it would exceed one of the quotas in which
+// case nothing is counted and an *ExceededError is returned.
+func (m *Meter) Consume(key string, n int64, q Quota) (Report, error) {
+	now := time.Now().UTC()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	r, ok := m.records[key]
+	if !ok {
+		r = &record{}
+		m.records[key] = r
+	}
+	r.roll(now)
+
+	if q.Daily > 0 && r.Daily+n > q.Daily {
+		return report(r, q, now), &ExceededError{Period: Daily, Quota: q.Daily, Reset: nextDay(now)}
+	}
+	if q.Monthly > 0 && r.Monthly+n > q.Monthly {
+		return report(r, q, now), &ExceededError{Period: Monthly, Quota: q.Monthly, Reset: nextMonth(now)}
+	}
+	r.Daily += n
+	r.Monthly += n
+	m.dirty = true
+	return report(r, q, now), nil
+}
+
+// Refund uncounts n items consumed by key which weren't served. Items consumed in a period
+// which has ended since are not refunded.
+func (m *Meter) Refund(key string, n int64) {
+	now := time.Now().UTC()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	r, ok := m.records[key]
+	if !ok {
+		return
+	}
+	r.roll(now)
+	r.Daily -= n
+	if r.Daily < 0 {
+		r.Daily = 0
+	}
+	r.Monthly -= n
+	if r.Monthly < 0 {
+		r.Monthly = 0
+	}
+	m.dirty = true
+}
+
+// Usage returns the consumption of key over the current periods.
+func (m *Meter) Usage(key string, q Quota) Report {
+	now := time.Now().UTC()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	r := record{}
+	if stored, ok := m.records[key]; ok {
+		r = *stored
+	}
+	r.roll(now)
+	return report(&r, q, now)
+}
+
+// report builds the report of a record rolled to now.
+func report(r *record, q Quota, now time.Time) Report {
+	return Report{
+		Daily:   Counter{Used: r.Daily, Quota: q.Daily, Reset: nextDay(now)},
+		Monthly: Counter{Used: r.Monthly, Quota: q.Monthly, Reset: nextMonth(now)},
+	}
+}
+
+func nextDay(now time.Time) time.Time {
+	y, mo, d := now.Date()
+	return time.Date(y, mo, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextMonth(now time.Time) time.Time {
+	y, mo, _ := now.Date()
+	return time.Date(y, mo+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Save writes the counters of the current month to the store. The file is replaced atomically.
+func (m *Meter) Save() error {
+	if m.path == "" {
+		return fmt.Errorf("no usage store configured")
+	}
+
+	month := time.Now().UTC().Format(monthLayout)
+	m.lock.Lock()
+	records := make(map[string]record, len(m.records))
+	for key, r := range m.records {
+		// the counters of the past months are useless
+		if r.Month == month {
+			records[key] = *r
+		}
+	}
+	m.dirty = false
+	m.lock.Unlock()
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// load reads the counters of the store.
+func (m *Meter) load() error {
+	b, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	records := make(map[string]*record)
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("invalid usage store %s: %w", m.path, err)
+	}
+	m.lock.Lock()
+	m.records = records
+	m.lock.Unlock()
+	return nil
+}
+
+// flusher saves the counters every interval when they changed, until the meter is closed.
+func (m *Meter) flusher() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.lock.Lock()
+			dirty := m.dirty
+			m.lock.Unlock()
+			if dirty {
+				_ = m.Save()
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Close stops the periodic saves and writes the counters a last time.
+func (m *Meter) Close() error {
+	m.once.Do(func() { close(m.stop) })
+	<-m.done
+	if m.path == "" {
+		return nil
+	}
+	return m.Save()
+}
@@ -0,0 +1,189 @@
+package xcache
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is returned by a Backend when a key is missing or expired.
+var ErrNotFound = errors.New("xcache: key not found")
+
+// Backend is a second cache tier, usually shared between several replicas.
+// Values are stored encoded, and expire after the given TTL.
+type Backend interface {
+	Get(key string) ([]byte, time.Duration, error) // value and remaining TTL, or ErrNotFound
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+// Sweeper is a Backend which doesn't remove its expired entries by itself.
+// Sweep removes them, and returns the number of entries removed.
+type Sweeper interface {
+	Sweep() (int, error)
+}
+
+// WithBackend sets the second tier of the cache. Entries are looked up in memory first,
+// then in the backend, then fetched; fetched entries are written to both tiers.
+// Backend failures are ignored: the backend is skipped for WithBackendRetry() after a failure.
+// Values are encoded with the codec set by WithCodec().
+// Default: nil (memory only)
+func WithBackend(b Backend) Option {
+	return func(c *Cache) {
+		c.backend = b
+	}
+}
+
+// WithBackendRetry sets for how long the backend is skipped after a failure.
+// The entries invalidated meanwhile are deleted from the backend once it is usable again.
+// Default: 5 * time.Second
+func WithBackendRetry(t time.Duration) Option {
+	return func(c *Cache) {
+		c.backendRetry = t
+	}
+}
+
+// WithBackendSweep sets how often the expired entries are removed from a backend
+// implementing Sweeper, 0 disables it.
+// Default: 10 * time.Minute
+func WithBackendSweep(t time.Duration) Option {
+	return func(c *Cache) {
+		c.backendSweep = t
+	}
+}
+
+// backendUsable tells if the backend is set and didn't fail recently.
+// The deletes queued while the backend was skipped are sent first.
+func (c *Cache) backendUsable() bool {
+	if c.backend == nil || time.Now().UnixNano() < atomic.LoadInt64(&c.backendRetryAt) {
+		return false
+	}
+	if atomic.LoadInt32(&c.pendingCount) > 0 {
+		c.flushDeletes()
+	}
+	return time.Now().UnixNano() >= atomic.LoadInt64(&c.backendRetryAt)
+}
+
+// backendFailed counts a backend failure and skips the backend for a while.
+func (c *Cache) backendFailed() {
+	atomic.AddUint64(&c.backendErrors, 1)
+	atomic.StoreInt64(&c.backendRetryAt, time.Now().Add(c.backendRetry).UnixNano())
+}
+
+// backendGet looks up an entry in the backend and stores it in memory if found. Only an entry
+// created after the given time is accepted.
+func (c *Cache) backendGet(key string, after time.Time) (interface{}, Info, bool) {
+	if !c.backendUsable() {
+		return nil, Info{}, false
+	}
+	b, ttl, err := c.backend.Get(key)
+	if err == ErrNotFound {
+		return nil, Info{}, false
+	} else if err != nil {
+		c.backendFailed()
+		return nil, Info{}, false
+	}
+
+	pe, _, err := c.decodeEntry(key, b)
+	if err != nil {
+		return nil, Info{}, false
+	}
+	if pe.created.UnixNano() < atomic.LoadInt64(&c.purgedAt) {
+		// written before the last purge
+		c.backendDelete(key)
+		return nil, Info{}, false
+	}
+	if !pe.created.After(after) {
+		return nil, Info{}, false
+	}
+
+	atomic.AddUint64(&c.backendHits, 1)
+	c.setPos(pe, ttl)
+	return pe.x, Info{Status: StatusBackendHit, Age: time.Since(pe.created), TTL: ttl}, true
+}
+
+// backendSet writes a positive entry to the backend.
+func (c *Cache) backendSet(pe *posCacheEntry, ttl time.Duration) {
+	if !c.backendUsable() {
+		return
+	}
+	b, err := c.encodeEntry(pe, ttl)
+	if err != nil {
+		return
+	}
+	if err := c.backend.Set(pe.key, b, ttl); err != nil {
+		c.backendFailed()
+	}
+}
+
+// backendDelete removes an entry from the backend. The delete is queued if the backend
+// is skipped or fails, unless the queue is full.
+func (c *Cache) backendDelete(key string) {
+	if c.backend == nil {
+		return
+	}
+	if !c.backendUsable() {
+		c.queueDelete(key)
+		return
+	}
+	if err := c.backend.Delete(key); err != nil {
+		c.backendFailed()
+		c.queueDelete(key)
+	}
+}
+
+// queueDelete queues the delete of key from the backend, for when it is usable again.
+// The delete is dropped and counted as a backend error if the queue is full.
+func (c *Cache) queueDelete(key string) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if _, ok := c.pendingDeletes[key]; ok {
+		return
+	}
+	if len(c.pendingDeletes) >= int(c.posSize) {
+		atomic.AddUint64(&c.backendErrors, 1)
+		return
+	}
+	c.pendingDeletes[key] = struct{}{}
+	atomic.AddInt32(&c.pendingCount, 1)
+}
+
+// flushDeletes sends the queued deletes to the backend, until one fails.
+func (c *Cache) flushDeletes() {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	for key := range c.pendingDeletes {
+		if err := c.backend.Delete(key); err != nil {
+			c.backendFailed()
+			return
+		}
+		delete(c.pendingDeletes, key)
+		atomic.AddInt32(&c.pendingCount, -1)
+	}
+}
+
+// backendSweeper removes the expired entries of the backend periodically.
+func (c *Cache) backendSweeper(s Sweeper) {
+	ticker := time.NewTicker(c.backendSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Sweep(); err != nil {
+				atomic.AddUint64(&c.backendErrors, 1)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// BackendHits returns the number of entries found in the backend, since start.
+func (c *Cache) BackendHits() uint64 {
+	return atomic.LoadUint64(&c.backendHits)
+}
+
+// BackendErrors returns the number of backend failures, since start.
+func (c *Cache) BackendErrors() uint64 {
+	return atomic.LoadUint64(&c.backendErrors)
+}
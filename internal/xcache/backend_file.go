@@ -0,0 +1,122 @@
+package xcache
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileBackend is a Backend storing each entry in a file of a directory,
+// which can be shared between replicas on a network file system.
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend builds a FileBackend storing entries in dir, created if missing.
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBackend{dir: dir}, nil
+}
+
+// path returns the file storing a key.
+func (b *FileBackend) path(key string) string {
+	h := sha1.Sum([]byte(key))
+	return filepath.Join(b.dir, hex.EncodeToString(h[:]))
+}
+
+// Get implements Backend.
+// A file starts with the expiration time of the entry, in unix nanoseconds.
+func (b *FileBackend) Get(key string) ([]byte, time.Duration, error) {
+	buf, err := os.ReadFile(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < 8 {
+		return nil, 0, fmt.Errorf("truncated cache file for key %q", key)
+	}
+
+	ttl := time.Until(time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8]))))
+	if ttl <= 0 {
+		_ = os.Remove(b.path(key))
+		return nil, 0, ErrNotFound
+	}
+	return buf[8:], ttl, nil
+}
+
+// Set implements Backend. The file is replaced atomically.
+func (b *FileBackend) Set(key string, value []byte, ttl time.Duration) error {
+	tmp, err := os.CreateTemp(b.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(time.Now().Add(ttl).UnixNano()))
+	if _, err := tmp.Write(expires); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path(key))
+}
+
+// Delete implements Backend.
+func (b *FileBackend) Delete(key string) error {
+	if err := os.Remove(b.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sweep implements Sweeper: expired files are otherwise only removed when their key is read.
+func (b *FileBackend) Sweep() (int, error) {
+	files, err := os.ReadDir(b.dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".tmp") {
+			continue
+		}
+		path := filepath.Join(b.dir, file.Name())
+		if !expired(path) {
+			continue
+		}
+		if err := os.Remove(path); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// expired tells if the file of an entry has expired, reading its header only.
+func expired(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return time.Now().UnixNano() >= int64(binary.BigEndian.Uint64(header))
+}
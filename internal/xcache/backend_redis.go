@@ -0,0 +1,217 @@
+package xcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisBackend is a Backend speaking the Redis protocol (RESP) over TCP.
+// It only relies on the GET, SET (with PX), PTTL and DEL commands.
+type RedisBackend struct {
+	addr    string
+	timeout time.Duration
+	pool    chan *redisConn // idle connections
+}
+
+// redisConn is a connection to the Redis server.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedisBackend builds a RedisBackend for the server at addr, keeping at most poolSize
+// idle connections. Connections are opened lazily, and every command must complete within timeout.
+func NewRedisBackend(addr string, timeout time.Duration, poolSize int) *RedisBackend {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	return &RedisBackend{
+		addr:    addr,
+		timeout: timeout,
+		pool:    make(chan *redisConn, poolSize),
+	}
+}
+
+// Get implements Backend.
+func (b *RedisBackend) Get(key string) ([]byte, time.Duration, error) {
+	replies, err := b.do([]string{"GET", key}, []string{"PTTL", key})
+	if err != nil {
+		return nil, 0, err
+	}
+	value, ok := replies[0].([]byte)
+	if !ok || value == nil {
+		return nil, 0, ErrNotFound
+	}
+	ms, ok := replies[1].(int64)
+	if !ok {
+		return nil, 0, fmt.Errorf("redis: unexpected PTTL reply %v", replies[1])
+	}
+	if ms < 0 {
+		// -2: expired in between, -1: no expiration, should not happen
+		return nil, 0, ErrNotFound
+	}
+	return value, time.Duration(ms) * time.Millisecond, nil
+}
+
+// Set implements Backend.
+func (b *RedisBackend) Set(key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := b.do([]string{"SET", key, string(value), "PX", strconv.FormatInt(ms, 10)})
+	return err
+}
+
+// Delete implements Backend.
+func (b *RedisBackend) Delete(key string) error {
+	_, err := b.do([]string{"DEL", key})
+	return err
+}
+
+// Close closes the idle connections.
+func (b *RedisBackend) Close() error {
+	for {
+		select {
+		case c := <-b.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the commands in a pipeline and returns their replies.
+// An error reply of the server is returned as an error.
+func (b *RedisBackend) do(cmds ...[]string) ([]interface{}, error) {
+	c, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.conn.SetDeadline(time.Now().Add(b.timeout)); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		writeCommand(c.w, cmd)
+	}
+	if err := c.w.Flush(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	replies := make([]interface{}, 0, len(cmds))
+	var replyErr error
+	for range cmds {
+		reply, err := readReply(c.r)
+		var rerr redisError
+		if errors.As(err, &rerr) {
+			// the connection is still usable
+			replyErr = err
+		} else if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	b.put(c)
+	return replies, replyErr
+}
+
+// get returns an idle connection, or opens a new one.
+func (b *RedisBackend) get() (*redisConn, error) {
+	select {
+	case c := <-b.pool:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", b.addr, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// put gives back a connection to the pool, or closes it if the pool is full.
+func (b *RedisBackend) put(c *redisConn) {
+	select {
+	case b.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// writeCommand encodes a command as a RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readReply decodes a RESP reply: a string, a redisError, an int64,
+// a []byte (nil for a null bulk string) or a []interface{}.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", line)
+}
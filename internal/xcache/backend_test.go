@@ -0,0 +1,363 @@
+package xcache
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redisStandIn is a minimal in-process server speaking the subset of the Redis protocol
+// used by RedisBackend.
+type redisStandIn struct {
+	ln      net.Listener
+	lock    sync.Mutex
+	values  map[string][]byte
+	expires map[string]time.Time
+}
+
+func newRedisStandIn(t *testing.T) *redisStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &redisStandIn{ln: ln, values: map[string][]byte{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *redisStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		if _, err := conn.Write([]byte(s.exec(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *redisStandIn) exec(args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := args[1]
+	if exp, ok := s.expires[key]; ok && time.Now().After(exp) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := s.values[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(v)) + "\r\n" + string(v) + "\r\n"
+	case "SET":
+		s.values[key] = []byte(args[2])
+		ms, _ := strconv.Atoi(args[4])
+		s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "PTTL":
+		exp, ok := s.expires[key]
+		if !ok {
+			return ":-2\r\n"
+		}
+		return ":" + strconv.FormatInt(time.Until(exp).Milliseconds(), 10) + "\r\n"
+	case "DEL":
+		_, ok := s.values[key]
+		delete(s.values, key)
+		delete(s.expires, key)
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func testBackend(t *testing.T, b Backend) {
+	if _, _, err := b.Get("missing"); err != ErrNotFound {
+		t.Fatalf("want ErrNotFound for a missing key, have %v", err)
+	}
+
+	if err := b.Set("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	v, ttl, err := b.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value" || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("bad entry, have %q with TTL %s", v, ttl)
+	}
+
+	if err := b.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Get("key"); err != ErrNotFound {
+		t.Fatalf("want ErrNotFound for a deleted key, have %v", err)
+	}
+
+	if err := b.Set("short", []byte("value"), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, _, err := b.Get("short"); err != ErrNotFound {
+		t.Fatalf("want ErrNotFound for an expired key, have %v", err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	b, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+func TestRedisBackend(t *testing.T) {
+	s := newRedisStandIn(t)
+	testBackend(t, NewRedisBackend(s.ln.Addr().String(), time.Second, 2))
+}
+
+func TestCacheWithBackend(t *testing.T) {
+	s := newRedisStandIn(t)
+	fetches := 0
+	f := Fetcher(func() (interface{}, bool, error) {
+		fetches++
+		return []byte("fizz"), true, nil
+	})
+
+	// two replicas sharing the same backend
+	one, _ := New(WithBackend(NewRedisBackend(s.ln.Addr().String(), time.Second, 2)))
+	two, _ := New(WithBackend(NewRedisBackend(s.ln.Addr().String(), time.Second, 2)))
+
+	if _, info, _ := one.FetchInfo("key", f.toResult()); info.Status != StatusMiss {
+		t.Fatalf("want %s on first replica, have %s", StatusMiss, info.Status)
+	}
+	x, info, err := two.FetchInfo("key", f.toResult())
+	if err != nil || string(x.([]byte)) != "fizz" {
+		t.Fatalf("bad value from second replica, have %v, %v", x, err)
+	}
+	if info.Status != StatusBackendHit {
+		t.Fatalf("want %s on second replica, have %s", StatusBackendHit, info.Status)
+	}
+	if _, info, _ := two.FetchInfo("key", f.toResult()); info.Status != StatusHit {
+		t.Fatalf("want %s once in memory, have %s", StatusHit, info.Status)
+	}
+	if fetches != 1 {
+		t.Fatalf("want 1 fetch, have %d", fetches)
+	}
+}
+
+func TestCacheWithBackendDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c, _ := New(WithBackend(NewRedisBackend(addr, 100*time.Millisecond, 1)))
+	f := func() (interface{}, bool, error) {
+		return []byte("fizz"), true, nil
+	}
+	x, err := c.Fetch("key", f)
+	if err != nil || string(x.([]byte)) != "fizz" {
+		t.Fatalf("want the fetched value with the backend down, have %v, %v", x, err)
+	}
+	if c.BackendErrors() == 0 {
+		t.Fatal("want backend errors to be counted")
+	}
+}
+
+// memBackend is a Backend in memory, which fails while down.
+type memBackend struct {
+	lock   sync.Mutex
+	values map[string][]byte
+	down   bool
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{values: map[string][]byte{}}
+}
+
+func (b *memBackend) Get(key string) ([]byte, time.Duration, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.down {
+		return nil, 0, errors.New("backend down")
+	}
+	v, ok := b.values[key]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return v, time.Minute, nil
+}
+
+func (b *memBackend) Set(key string, value []byte, ttl time.Duration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.down {
+		return errors.New("backend down")
+	}
+	b.values[key] = value
+	return nil
+}
+
+func (b *memBackend) Delete(key string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.down {
+		return errors.New("backend down")
+	}
+	delete(b.values, key)
+	return nil
+}
+
+func (b *memBackend) setDown(down bool) {
+	b.lock.Lock()
+	b.down = down
+	b.lock.Unlock()
+}
+
+func (b *memBackend) has(key string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.values[key]
+	return ok
+}
+
+func TestFileBackendSweep(t *testing.T) {
+	b, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Set("fresh", []byte("value"), time.Minute)
+	b.Set("short", []byte("value"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	if n, err := b.Sweep(); n != 1 || err != nil {
+		t.Fatalf("want 1 expired entry removed, have %d, %v", n, err)
+	}
+	if _, err := os.Stat(b.path("short")); !os.IsNotExist(err) {
+		t.Fatalf("want the expired file removed, have %v", err)
+	}
+	if _, _, err := b.Get("fresh"); err != nil {
+		t.Fatalf("want the fresh entry kept, have %v", err)
+	}
+}
+
+func TestCacheWithBackendInvalidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       func(c *Cache)
+		replicas bool // whether the other replicas fetch the entry again too
+	}{
+		{name: "key", op: func(c *Cache) { c.Invalidate("key") }, replicas: true},
+		{name: "tag", op: func(c *Cache) { c.InvalidateTag("tag") }, replicas: true},
+		{name: "purge", op: func(c *Cache) { c.Purge() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newMemBackend()
+			one, _ := New(WithBackend(b))
+			two, _ := New(WithBackend(b))
+			fetch := func() (Result, error) {
+				return Result{Value: []byte("fizz"), Valid: true, Tags: []string{"tag"}}, nil
+			}
+			one.FetchInfo("key", fetch)
+			time.Sleep(time.Millisecond)
+
+			tt.op(one)
+			if _, info, _ := one.FetchInfo("key", fetch); info.Status != StatusMiss {
+				t.Fatalf("want %s after the invalidation, have %s", StatusMiss, info.Status)
+			}
+
+			// a replica reads the entry fetched again, or the one written before a purge of another replica
+			one.Invalidate("key")
+			one.FetchInfo("key", fetch)
+			tt.op(one)
+			_, info, _ := two.FetchInfo("key", fetch)
+			if want := map[bool]Status{true: StatusMiss, false: StatusBackendHit}[tt.replicas]; info.Status != want {
+				t.Fatalf("want %s on the other replica, have %s", want, info.Status)
+			}
+		})
+	}
+}
+
+func TestCacheWithBackendQueuedDelete(t *testing.T) {
+	b := newMemBackend()
+	c, _ := New(WithBackend(b), WithBackendRetry(50*time.Millisecond))
+	c.Fetch("key", func() (interface{}, bool, error) { return []byte("fizz"), true, nil })
+
+	b.setDown(true)
+	c.Invalidate("key")
+	if c.BackendErrors() != 1 {
+		t.Fatalf("want the failed delete counted, have %d backend errors", c.BackendErrors())
+	}
+	b.setDown(false)
+	c.Invalidate("other")
+	if !b.has("key") {
+		t.Fatal("want the backend skipped until the retry")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, info, _ := c.FetchInfo("key", func() (Result, error) {
+		return Result{Value: []byte("fizz"), Valid: true}, nil
+	}); info.Status != StatusMiss {
+		t.Fatalf("want %s once the queued delete is sent, have %s", StatusMiss, info.Status)
+	}
+}
+
+func TestCacheWithBackendEarlyRefresh(t *testing.T) {
+	c, _ := New(WithBackend(newMemBackend()), WithEarlyRefresh(1e6), WithTTL(time.Minute))
+	defer c.Close()
+	fetches := make(chan struct{}, 2)
+	n := 0
+	fetch := func() (Result, error) {
+		time.Sleep(5 * time.Millisecond)
+		n++
+		defer func() { fetches <- struct{}{} }()
+		return Result{Value: []byte("v" + strconv.Itoa(n)), Valid: true}, nil
+	}
+	c.FetchInfo("key", fetch)
+	<-fetches
+
+	// the backend holds the same entry as memory, it must not replace the refresh
+	c.FetchInfo("key", fetch)
+	select {
+	case <-fetches:
+	case <-time.After(time.Second):
+		t.Fatal("want the entry refreshed early")
+	}
+	if have := c.EarlyFetches(); have != 1 {
+		t.Fatalf("want 1 early fetch, have %d", have)
+	}
+	if x, _, _ := c.FetchInfo("key", fetch); string(x.([]byte)) != "v2" {
+		t.Fatalf("want the refreshed value, have %s", x)
+	}
+}
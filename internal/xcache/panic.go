@@ -0,0 +1,49 @@
+package xcache
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/ariden83/fizz-buzz/internal/catcher"
+)
+
+// PanicError is the error of a fetch which panicked. Like other fetch errors, it ends in
+// the negative cache.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("fetcher panicked: %v", e.Value)
+}
+
+// PanicHandler is called with the key and the error of a fetch which panicked.
+type PanicHandler func(key string, err *PanicError)
+
+// WithPanicHandler sets the function called when a fetcher panics, whether it runs for a
+// request or in a stale fetcher goroutine.
+// Default: nil (the panic is only turned into an error)
+func WithPanicHandler(h PanicHandler) Option {
+	return func(c *Cache) {
+		c.onPanic = h
+	}
+}
+
+// call runs a fetcher, turning its panics into a *PanicError so that a panicking fetcher
+// neither kills a stale fetcher goroutine nor leaves its key locked.
+func (c *Cache) call(key string, f ResultFetcher) (res Result, err error) {
+	catcher.Block{
+		Try: func() {
+			res, err = f()
+		},
+		Catch: func(e catcher.Exception) {
+			perr := &PanicError{Value: e, Stack: debug.Stack()}
+			res, err = Result{}, perr
+			if c.onPanic != nil {
+				c.onPanic(key, perr)
+			}
+		},
+	}.Do()
+	return res, err
+}
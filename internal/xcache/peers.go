@@ -0,0 +1,259 @@
+package xcache
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PeersPath is the path of the HTTP handler serving the keys owned by a replica.
+const PeersPath = "/_xcache/"
+
+// PeerSecretHeader is the header carrying the secret shared by the replicas in the
+// requests to PeerHandler().
+const PeerSecretHeader = "X-Xcache-Secret"
+
+// Peer is a replica owning some keys.
+type Peer interface {
+	// Fetch returns the encoded entry of a key owned by the peer.
+	Fetch(key string) ([]byte, error)
+}
+
+// PeerPicker chooses the replica owning a key.
+type PeerPicker interface {
+	// PickPeer returns the peer owning key, or false if the key is owned by the local
+	// replica or if its owner is unavailable.
+	PickPeer(key string) (Peer, bool)
+}
+
+// Loader rebuilds the fetcher of a key, so that a replica can compute the keys
+// it owns on behalf of its peers. It must return an error for a key that the replica
+// wouldn't have built itself.
+type Loader func(key string) (ResultFetcher, error)
+
+// WithPeers distributes the keys between replicas: a key missing from the cache is asked to the
+// replica owning it, and only computed by the owner, which must be set up with WithLoader()
+// and serve PeerHandler(). If the owner fails, the key is computed locally.
+// Default: nil (keys are computed locally)
+func WithPeers(p PeerPicker) Option {
+	return func(c *Cache) {
+		c.peers = p
+	}
+}
+
+// WithLoader sets the function rebuilding the fetcher of the keys asked by the peers.
+// Default: nil
+func WithLoader(l Loader) Option {
+	return func(c *Cache) {
+		c.loader = l
+	}
+}
+
+// WithPeerSecret sets the secret shared by the replicas, which PeerHandler() requires
+// in the PeerSecretHeader of the requests. The HTTPPool of the replicas must send the same one.
+// Default: "" (PeerHandler() rejects every request)
+func WithPeerSecret(secret string) Option {
+	return func(c *Cache) {
+		c.peerSecret = secret
+	}
+}
+
+// peerGet asks a key to the peer owning it and stores it in memory if found. Only an entry
+// created after the given time is accepted.
+func (c *Cache) peerGet(key string, after time.Time) (interface{}, Info, bool) {
+	if c.peers == nil {
+		return nil, Info{}, false
+	}
+	peer, ok := c.peers.PickPeer(key)
+	if !ok {
+		return nil, Info{}, false
+	}
+	b, err := peer.Fetch(key)
+	if err != nil {
+		atomic.AddUint64(&c.peerErrors, 1)
+		return nil, Info{}, false
+	}
+	pe, ttl, err := c.decodeEntry(key, b)
+	if err != nil {
+		atomic.AddUint64(&c.peerErrors, 1)
+		return nil, Info{}, false
+	}
+	// an expired or older entry is not a failure of the owner, the key is fetched here instead
+	if ttl <= 0 || !pe.created.After(after) {
+		return nil, Info{}, false
+	}
+
+	atomic.AddUint64(&c.peerHits, 1)
+	c.setPos(pe, ttl)
+	return pe.x, Info{Status: StatusPeerHit, Age: time.Since(pe.created), TTL: ttl}, true
+}
+
+// PeerHandler returns the HTTP handler serving the keys owned by this replica to its peers.
+// The key is given by the "key" query parameter, and the requests must carry the secret set
+// by WithPeerSecret().
+func (c *Cache) PeerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(PeerSecretHeader)
+		if c.peerSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(c.peerSecret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		if c.loader == nil {
+			http.Error(w, "no loader", http.StatusNotFound)
+			return
+		}
+		f, err := c.loader(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		x, info, err := c.fetchInfo(key, f, false)
+		if err == nil && info.Status == StatusStale {
+			// the requester only stores fresh entries: refresh it now rather than in the background
+			c.fetchLimiter <- struct{}{}
+			atomic.AddUint64(&c.staleFetches, 1)
+			x, info, err = c.cacheItem(key, f)
+			<-c.fetchLimiter
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// send the cached entry if any, to keep its metadata
+		pe := &posCacheEntry{key: key, x: x, created: time.Now().Add(-info.Age)}
+		ttl := info.TTL
+		if item := c.posCache.Get(key); item != nil && !item.Expired() {
+			pe = item.Value().(*posCacheEntry)
+			ttl = item.TTL()
+		}
+		b, err := c.encodeEntry(pe, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(b)
+	})
+}
+
+// PeerHits returns the number of entries obtained from peers, since start.
+func (c *Cache) PeerHits() uint64 {
+	return atomic.LoadUint64(&c.peerHits)
+}
+
+// PeerErrors returns the number of failed requests to peers, since start.
+func (c *Cache) PeerErrors() uint64 {
+	return atomic.LoadUint64(&c.peerErrors)
+}
+
+// HTTPPool is a PeerPicker assigning keys to replicas with a consistent-hash ring,
+// and asking them over HTTP.
+type HTTPPool struct {
+	self  string
+	ring  *Ring
+	peers map[string]*httpPeer
+}
+
+// httpPeer is a Peer reached over HTTP.
+type httpPeer struct {
+	url       string
+	secret    string // sent in the PeerSecretHeader
+	client    *http.Client
+	retry     time.Duration // how long the peer is skipped after a failure
+	downUntil int64         // unix nano time until which the peer is skipped
+}
+
+// NewHTTPPool builds a pool for the replica reachable at self, among the replicas at addrs
+// (host:port, self included or not), sharing secret. Requests to a peer must complete
+// within timeout, and a failing peer is skipped for retry.
+func NewHTTPPool(self string, addrs []string, secret string, timeout, retry time.Duration) *HTTPPool {
+	p := &HTTPPool{
+		self:  self,
+		peers: make(map[string]*httpPeer),
+	}
+	client := &http.Client{Timeout: timeout}
+
+	nodes := []string{self}
+	for _, addr := range addrs {
+		if addr == self || addr == "" {
+			continue
+		}
+		if _, ok := p.peers[addr]; ok {
+			continue
+		}
+		nodes = append(nodes, addr)
+		p.peers[addr] = &httpPeer{
+			url:    "http://" + addr + PeersPath,
+			secret: secret,
+			client: client,
+			retry:  retry,
+		}
+	}
+	p.ring = NewRing(50, nodes...)
+	return p
+}
+
+// PickPeer implements PeerPicker.
+func (p *HTTPPool) PickPeer(key string) (Peer, bool) {
+	owner := p.ring.Get(key)
+	if owner == p.self {
+		return nil, false
+	}
+	peer, ok := p.peers[owner]
+	if !ok || peer.down() {
+		return nil, false
+	}
+	return peer, true
+}
+
+// Owner returns the address of the replica owning key.
+func (p *HTTPPool) Owner(key string) string {
+	return p.ring.Get(key)
+}
+
+// Fetch implements Peer.
+func (p *httpPeer) Fetch(key string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url+"?key="+url.QueryEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(PeerSecretHeader, p.secret)
+	res, err := p.client.Do(req)
+	if err != nil {
+		p.failed()
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		p.failed()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %s: %s: %s", p.url, res.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// down tells if the peer failed recently.
+func (p *httpPeer) down() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&p.downUntil)
+}
+
+// failed skips the peer for a while.
+func (p *httpPeer) failed() {
+	atomic.StoreInt64(&p.downUntil, time.Now().Add(p.retry).UnixNano())
+}
@@ -0,0 +1,228 @@
+package xcache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPeers starts n replicas on loopback ports, each one counting the keys it computes.
+func testPeers(t *testing.T, n int, opts ...Option) ([]*Cache, []*HTTPPool, []*uint64) {
+	var (
+		lns    []net.Listener
+		addrs  []string
+		caches []*Cache
+		pools  []*HTTPPool
+		counts []*uint64
+	)
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	for i := 0; i < n; i++ {
+		count := new(uint64)
+		loader := func(key string) (ResultFetcher, error) {
+			return func() (Result, error) {
+				atomic.AddUint64(count, 1)
+				return Result{Value: []byte("fizz:" + key), Valid: true}, nil
+			}, nil
+		}
+		pool := NewHTTPPool(addrs[i], addrs, "secret", time.Second, time.Minute)
+		c, err := New(append([]Option{WithPeers(pool), WithLoader(loader), WithPeerSecret("secret")}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: c.PeerHandler()}
+		go srv.Serve(lns[i])
+		t.Cleanup(func() { srv.Close() })
+
+		caches = append(caches, c)
+		pools = append(pools, pool)
+		counts = append(counts, count)
+	}
+	return caches, pools, counts
+}
+
+// ownedBy returns a key owned by the replica at addr.
+func ownedBy(t *testing.T, pool *HTTPPool, addr string) string {
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if pool.Owner(key) == addr {
+			return key
+		}
+	}
+	t.Fatalf("no key owned by %s", addr)
+	return ""
+}
+
+func TestRing(t *testing.T) {
+	r := NewRing(50, "a", "b", "c")
+	owners := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owners[r.Get(fmt.Sprintf("key-%d", i))]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if owners[node] < 500 {
+			t.Fatalf("keys badly spread, have %v", owners)
+		}
+	}
+
+	// adding a node only moves keys to that node
+	r2 := NewRing(50, "a", "b", "c", "d")
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if before, after := r.Get(key), r2.Get(key); before != after && after != "d" {
+			t.Fatalf("key %s moved from %s to %s", key, before, after)
+		}
+	}
+
+	if NewRing(50).Get("key") != "" {
+		t.Fatal("want no owner on an empty ring")
+	}
+}
+
+func TestCacheWithPeers(t *testing.T) {
+	caches, pools, counts := testPeers(t, 3)
+	owner := pools[1].self
+	key := ownedBy(t, pools[0], owner)
+
+	local := func() (Result, error) {
+		t.Fatal("key computed by a replica not owning it")
+		return Result{}, nil
+	}
+	x, info, err := caches[0].FetchInfo(key, local)
+	if err != nil || string(x.([]byte)) != "fizz:"+key {
+		t.Fatalf("bad value from peer, have %v, %v", x, err)
+	}
+	if info.Status != StatusPeerHit {
+		t.Fatalf("want %s, have %s", StatusPeerHit, info.Status)
+	}
+	if _, info, _ := caches[2].FetchInfo(key, local); info.Status != StatusPeerHit {
+		t.Fatalf("want %s on third replica, have %s", StatusPeerHit, info.Status)
+	}
+	if _, info, _ := caches[0].FetchInfo(key, local); info.Status != StatusHit {
+		t.Fatalf("want %s once in memory, have %s", StatusHit, info.Status)
+	}
+	if n := atomic.LoadUint64(counts[1]); n != 1 {
+		t.Fatalf("want 1 computation by the owner, have %d", n)
+	}
+	if caches[0].PeerHits() != 1 {
+		t.Fatalf("want 1 peer hit, have %d", caches[0].PeerHits())
+	}
+}
+
+func TestCacheWithPeerExpired(t *testing.T) {
+	caches, pools, counts := testPeers(t, 2, WithTTL(50*time.Millisecond))
+	owner := pools[1].self
+	key := ownedBy(t, pools[0], owner)
+
+	f := func() (Result, error) {
+		atomic.AddUint64(counts[1], 1)
+		return Result{Value: []byte("fizz:" + key), Valid: true}, nil
+	}
+	if _, _, err := caches[1].FetchInfo(key, f); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	local := func() (Result, error) {
+		t.Fatal("key computed by a replica not owning it")
+		return Result{}, nil
+	}
+	x, info, err := caches[0].FetchInfo(key, local)
+	if err != nil || string(x.([]byte)) != "fizz:"+key {
+		t.Fatalf("bad value from peer, have %v, %v", x, err)
+	}
+	if info.Status != StatusPeerHit || info.TTL <= 0 {
+		t.Fatalf("want a fresh %s, have %s with TTL %s", StatusPeerHit, info.Status, info.TTL)
+	}
+	if caches[0].PeerErrors() != 0 {
+		t.Fatalf("want no peer error, have %d", caches[0].PeerErrors())
+	}
+	if n := atomic.LoadUint64(counts[1]); n < 2 {
+		t.Fatalf("want the owner to refresh its entry, have %d computations", n)
+	}
+}
+
+func TestCacheWithPeerDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := ln.Addr().String()
+	ln.Close()
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	pool := NewHTTPPool(self, []string{self, down}, "secret", 100*time.Millisecond, time.Minute)
+	c, _ := New(WithPeers(pool))
+	key := ownedBy(t, pool, down)
+
+	f := func() (interface{}, bool, error) {
+		return []byte("fizz"), true, nil
+	}
+	x, err := c.Fetch(key, f)
+	if err != nil || string(x.([]byte)) != "fizz" {
+		t.Fatalf("want the local value with the owner down, have %v, %v", x, err)
+	}
+	if c.PeerErrors() != 1 {
+		t.Fatalf("want 1 peer error, have %d", c.PeerErrors())
+	}
+
+	// the owner is skipped once failed
+	if _, ok := pool.PickPeer(key); ok {
+		t.Fatal("want the failed owner to be skipped")
+	}
+}
+
+func TestPeerHandlerSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string // of the handler
+		sent   string // in the request
+		want   int
+	}{
+		{name: "shared secret", secret: "secret", sent: "secret", want: http.StatusOK},
+		{name: "wrong secret", secret: "secret", sent: "wrong", want: http.StatusForbidden},
+		{name: "missing secret", secret: "secret", want: http.StatusForbidden},
+		{name: "no secret set", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			computed := false
+			loader := func(key string) (ResultFetcher, error) {
+				return func() (Result, error) {
+					computed = true
+					return Result{Value: []byte("fizz"), Valid: true}, nil
+				}, nil
+			}
+			c, _ := New(WithLoader(loader), WithPeerSecret(tt.secret))
+			r := httptest.NewRequest(http.MethodGet, PeersPath+"?key=key", nil)
+			if tt.sent != "" {
+				r.Header.Set(PeerSecretHeader, tt.sent)
+			}
+			w := httptest.NewRecorder()
+			c.PeerHandler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("want status %d, have %d", tt.want, w.Code)
+			}
+			if want := tt.want == http.StatusOK; computed != want {
+				t.Fatalf("want the key computed %t, have %t", want, computed)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package xcache
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring is a consistent-hash ring assigning keys to nodes. Each node is placed at several
+// points of the ring (virtual nodes) so that keys are evenly spread, and adding or
+// removing a node only moves the keys of that node.
+type Ring struct {
+	vnodes int
+	hashes []uint32          // sorted points of the ring
+	nodes  map[uint32]string // node at each point
+}
+
+// NewRing builds a ring placing each node at vnodes points.
+func NewRing(vnodes int, nodes ...string) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	r := &Ring{vnodes: vnodes, nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Get returns the node owning key, or "" if the ring is empty.
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
@@ -0,0 +1,201 @@
+package xcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot layout or the format of the keys changes,
+// so that the entries of an older snapshot are not loaded under keys nobody asks for.
+const snapshotVersion = 2
+
+// Codec serialises the values returned by a Fetcher so that they can be
+// written to a snapshot and loaded back on startup.
+type Codec interface {
+	Encode(interface{}) ([]byte, error)
+	Decode([]byte) (interface{}, error)
+}
+
+// BytesCodec is a Codec for caches storing []byte values.
+type BytesCodec struct{}
+
+// Encode implements Codec.
+func (BytesCodec) Encode(x interface{}) ([]byte, error) {
+	b, ok := x.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T, expected []byte", x)
+	}
+	return b, nil
+}
+
+// Decode implements Codec.
+func (BytesCodec) Decode(b []byte) (interface{}, error) {
+	return b, nil
+}
+
+// snapshot is the content of a snapshot file.
+type snapshot struct {
+	Version int
+	SavedAt time.Time
+	Entries []snapshotEntry
+}
+
+// snapshotEntry is a positive entry along with its remaining TTL at save time.
+type snapshotEntry struct {
+	Key     string
+	Value   []byte
+	TTL     time.Duration
+	Delta   time.Duration
+	Tags    []string
+	Created time.Time
+}
+
+// encodeEntry serialises a positive entry with its remaining TTL, for the backend and the peers.
+func (c *Cache) encodeEntry(pe *posCacheEntry, ttl time.Duration) ([]byte, error) {
+	b, err := c.codec.Encode(pe.x)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	e := snapshotEntry{Key: pe.key, Value: b, TTL: ttl, Delta: pe.delta, Tags: pe.tags, Created: pe.created}
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeEntry deserialises a positive entry encoded by encodeEntry() and returns it with its TTL.
+func (c *Cache) decodeEntry(key string, b []byte) (*posCacheEntry, time.Duration, error) {
+	var e snapshotEntry
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&e); err != nil {
+		return nil, 0, err
+	}
+	if e.Key != key {
+		return nil, 0, fmt.Errorf("entry of key %q received for key %q", e.Key, key)
+	}
+	x, err := c.codec.Decode(e.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	gen := atomic.LoadUint64(&c.generation)
+	return &posCacheEntry{key: key, x: x, delta: e.Delta, tags: e.Tags, gen: gen, created: e.Created}, e.TTL, nil
+}
+
+// SaveSnapshot writes the fresh positive entries to the snapshot file.
+// The file is replaced atomically. It returns the number of entries written.
+func (c *Cache) SaveSnapshot() (int, error) {
+	if c.snapshotPath == "" {
+		return 0, fmt.Errorf("no snapshot path configured")
+	}
+
+	snap := snapshot{Version: snapshotVersion, SavedAt: time.Now()}
+	c.forEachPos(func(pe *posCacheEntry) {
+		ttl := time.Until(pe.expires)
+		if ttl <= 0 {
+			return
+		}
+		b, err := c.codec.Encode(pe.x)
+		if err != nil {
+			return
+		}
+		snap.Entries = append(snap.Entries, snapshotEntry{
+			Key: pe.key, Value: b, TTL: ttl, Delta: pe.delta, Tags: pe.tags, Created: pe.created,
+		})
+	})
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.snapshotPath), filepath.Base(c.snapshotPath)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return len(snap.Entries), os.Rename(tmp.Name(), c.snapshotPath)
+}
+
+// LoadSnapshot fills the positive cache from the snapshot file, skipping entries
+// which expired since the snapshot was written. A missing file is not an error.
+// It returns the number of entries loaded.
+func (c *Cache) LoadSnapshot() (int, error) {
+	if c.snapshotPath == "" {
+		return 0, fmt.Errorf("no snapshot path configured")
+	}
+
+	f, err := os.Open(c.snapshotPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	elapsed := time.Since(snap.SavedAt)
+	gen := atomic.LoadUint64(&c.generation)
+	loaded := 0
+	for _, e := range snap.Entries {
+		ttl := e.TTL - elapsed
+		if ttl <= 0 {
+			continue
+		}
+		x, err := c.codec.Decode(e.Value)
+		if err != nil {
+			continue
+		}
+		c.setPos(&posCacheEntry{key: e.Key, x: x, delta: e.Delta, tags: e.Tags, gen: gen, created: e.Created}, ttl)
+		loaded++
+	}
+	return loaded, nil
+}
+
+// snapshotter periodically writes the snapshot until the cache is closed.
+func (c *Cache) snapshotter() {
+	ticker := time.NewTicker(c.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, _ = c.SaveSnapshot()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// forEachPos calls f for every entry of the index, which holds the entries of the positive
+// cache. The positive cache is not looked up, as a lookup would promote every entry and
+// reset the LRU order.
+func (c *Cache) forEachPos(f func(pe *posCacheEntry)) {
+	c.indexLock.Lock()
+	entries := make([]*posCacheEntry, 0, len(c.keys))
+	for _, pe := range c.keys {
+		entries = append(entries, pe)
+	}
+	c.indexLock.Unlock()
+
+	for _, pe := range entries {
+		f(pe)
+	}
+}
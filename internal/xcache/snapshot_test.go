@@ -0,0 +1,98 @@
+package xcache
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries map[string]time.Duration // key and TTL of the entries fetched before the save
+		wait    time.Duration            // between the save and the load
+		want    []string                 // keys loaded
+	}{
+		{
+			name:    "round trip",
+			entries: map[string]time.Duration{"one": time.Minute, "two": time.Minute},
+			want:    []string{"one", "two"},
+		},
+		{
+			name:    "entries expired before the save are skipped",
+			entries: map[string]time.Duration{"fresh": time.Minute, "expired": time.Millisecond},
+			want:    []string{"fresh"},
+		},
+		{
+			name:    "entries expired between the save and the load are skipped",
+			entries: map[string]time.Duration{"fresh": time.Minute, "short": 50 * time.Millisecond},
+			wait:    100 * time.Millisecond,
+			want:    []string{"fresh"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot")
+			c, _ := New(WithSnapshot(path, 0))
+			for key, ttl := range tt.entries {
+				key, ttl := key, ttl
+				c.FetchResult(key, func() (Result, error) {
+					return Result{Value: []byte("value:" + key), Valid: true, TTL: ttl, Tags: []string{"tag"}}, nil
+				})
+			}
+			time.Sleep(10 * time.Millisecond)
+			if _, err := c.SaveSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+
+			loaded, _ := New(WithSnapshot(path, 0))
+			n, err := loaded.LoadSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.want) {
+				t.Fatalf("want %d entries loaded, have %d", len(tt.want), n)
+			}
+			for _, key := range tt.want {
+				x, info, err := loaded.FetchInfo(key, func() (Result, error) {
+					t.Fatalf("fetch of the loaded key %q", key)
+					return Result{}, nil
+				})
+				if err != nil || string(x.([]byte)) != "value:"+key || info.Status != StatusHit {
+					t.Fatalf("bad entry %q, have %v, %s, %v", key, x, info.Status, err)
+				}
+			}
+			if n := loaded.InvalidateTag("tag"); n != len(tt.want) {
+				t.Fatalf("want the tags of the %d entries loaded, have %d", len(tt.want), n)
+			}
+		})
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	c, _ := New(WithSnapshot(path, 0))
+	if n, err := c.LoadSnapshot(); n != 0 || err != nil {
+		t.Fatalf("want nothing loaded without error from a missing file, have %d, %v", n, err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := snapshot{Version: snapshotVersion - 1, SavedAt: time.Now(), Entries: []snapshotEntry{
+		{Key: "old-format", Value: []byte("value"), TTL: time.Minute},
+	}}
+	if err := gob.NewEncoder(f).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if n, err := c.LoadSnapshot(); n != 0 || err == nil {
+		t.Fatalf("want an older snapshot rejected, have %d entries loaded, %v", n, err)
+	}
+}
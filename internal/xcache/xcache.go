@@ -5,14 +5,23 @@
 // It adds cache locking (prevents 2 concurrent fetches for the same item),
 // infinite serving of stale values in case of fetch errors,
 // asynchronous refresh of stale values,
+// probabilistic early refresh of popular values (XFetch) and TTL jitter,
 // concurrency-limited refresh fetchers,
-// and negative cache.
+// warm-up of entries ahead of requests,
+// per-entry TTL, invalidation by key or by tag,
+// an optional shared second tier (Backend),
+// distribution of the keys between replicas (PeerPicker),
+// negative cache, recovery of the panics of the fetchers,
+// and snapshots of the positive entries to disk for warm restarts.
 //
 // Its usage makes use of a single function Fetch() (no Get()/Set()), which is provided
 // with a closure capturing the parameters necessary to fetch for the given key.
 package xcache
 
 import (
+	"errors"
+	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,6 +35,8 @@ type Cache struct {
 	posSize      int32         // how many max cached entries
 	posPruneSize int32         // how many entries to evict on cache full
 	posTTL       time.Duration // how long until a positive entry is considered stale
+	ttlJitter    float64       // fraction of posTTL randomly removed from each entry TTL
+	earlyBeta    float64       // XFetch beta, > 1 favors earlier refreshes, 0 disables them
 
 	negCache     *ccache.Cache // negative cache: store currently invalid entries
 	negSize      int32         // how many max neg cached entries
@@ -49,11 +60,45 @@ type Cache struct {
 	maxFetchers  int           // max number of concurrent fetches
 	fetchLimiter chan struct{} // used as a semaphore for concurrency limit
 
+	keys       map[string]*posCacheEntry      // entries of the positive cache by key
+	tags       map[string]map[string]struct{} // keys of the positive cache by tag
+	indexLock  sync.Mutex                     // guard access to "keys" and "tags" maps
+	generation uint64                         // entries from an older generation have been purged
+
+	backend        Backend       // optional second tier
+	backendRetry   time.Duration // how long the backend is skipped after a failure
+	backendRetryAt int64         // unix nano time until which the backend is skipped
+	backendSweep   time.Duration // how often the expired entries of a Sweeper backend are removed
+	purgedAt       int64         // unix nano time of the last purge, older backend entries are ignored
+
+	pendingDeletes map[string]struct{} // deletes to send once the backend is usable again
+	pendingCount   int32               // number of pending deletes, read without the lock
+	pendingLock    sync.Mutex          // guard access to "pendingDeletes"
+
+	peers      PeerPicker // optional owners of the keys
+	loader     Loader     // rebuild the fetcher of the keys asked by peers
+	peerSecret string     // required in the requests of the peers
+
+	onPanic PanicHandler // notified of the panics of the fetchers
+
+	codec            Codec         // serialise values for snapshots, backend and peers
+	snapshotPath     string        // file storing the snapshot, disabled if empty
+	snapshotInterval time.Duration // how often a snapshot is written, disabled if 0
+	stop             chan struct{} // stop the periodic snapshot goroutine
+	stopOnce         sync.Once     // guard closing of "stop"
+
 	// instrumentation
 	hits         uint64 // cache hit counter
 	requests     uint64 // requests (hit+miss) counter
 	newFetches   uint64 // fetch counter for item not yet in cache
 	staleFetches uint64 // fetch counter for refreshing expired items
+	earlyFetches uint64 // counter of refreshes queued before expiration
+	warmFetches  uint64 // fetch counter for items fetched ahead of requests
+
+	backendHits   uint64 // backend hit counter
+	backendErrors uint64 // backend failure counter
+	peerHits      uint64 // counter of entries obtained from peers
+	peerErrors    uint64 // counter of failed requests to peers
 }
 
 // Fetcher is the type of the closure passed to Fetch() for fetching the desired object if missing or stale.
@@ -68,16 +113,96 @@ type Cache struct {
 // else (nil error nil and true validity) store in positive cache and remove neg entry
 type Fetcher func() (interface{}, bool, error)
 
+// Result is the outcome of a ResultFetcher. Value and Valid have the same meaning as the
+// values returned by a Fetcher.
+type Result struct {
+	Value interface{}
+	Valid bool
+	TTL   time.Duration // TTL of the entry, the cache TTL is used if 0
+	Tags  []string      // tags of the entry, for use with InvalidateTag()
+}
+
+// ResultFetcher is a Fetcher returning a Result, which allows setting a per-entry TTL and tags.
+type ResultFetcher func() (Result, error)
+
+// TransientError is a fetch error which is not stored in the negative cache, such as a fetch
+// refused by an overloaded server: the entry is fetched again by the next request.
+type TransientError struct {
+	Err error
+}
+
+// Transient marks err as a TransientError.
+func Transient(err error) error {
+	return &TransientError{Err: err}
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error marked as transient.
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// toResult adapts a Fetcher to a ResultFetcher.
+func (f Fetcher) toResult() ResultFetcher {
+	return func() (Result, error) {
+		x, valid, err := f()
+		return Result{Value: x, Valid: valid}, err
+	}
+}
+
+// Status tells how a value returned by the cache has been obtained.
+type Status string
+
+const (
+	// StatusHit is a fresh value from the positive cache.
+	StatusHit Status = "HIT"
+	// StatusMiss is a value fetched for the request.
+	StatusMiss Status = "MISS"
+	// StatusStale is an expired value from the positive cache, being refreshed.
+	StatusStale Status = "STALE"
+	// StatusNegative is a value or an error from the negative cache.
+	StatusNegative Status = "NEGATIVE"
+	// StatusBackendHit is a fresh value from the backend (second tier).
+	StatusBackendHit Status = "HIT_L2"
+	// StatusPeerHit is a value obtained from the replica owning it.
+	StatusPeerHit Status = "HIT_PEER"
+)
+
+// Info describes how a value returned by FetchInfo() has been obtained.
+type Info struct {
+	Status Status
+	Age    time.Duration // time since the value was fetched
+	TTL    time.Duration // time until the value expires, 0 if expired
+}
+
 // fetchReq stores a fetch request for async refresh.
 type fetchReq struct {
-	key string
-	f   Fetcher
+	key     string
+	f       ResultFetcher
+	early   bool      // whether the entry is refreshed before it expires
+	created time.Time // creation time of the entry refreshed
+}
+
+// posCacheEntry stores a valid fetch result for positive caching
+type posCacheEntry struct {
+	key     string
+	x       interface{}
+	delta   time.Duration // how long the Fetcher took to compute x
+	tags    []string
+	gen     uint64    // generation of the cache when the entry was stored
+	created time.Time // when the entry was fetched
+	expires time.Time // when the entry expires, set by setPos
 }
 
 // negCacheEntry stores an invalid fetch result for negative caching
 type negCacheEntry struct {
-	x   interface{}
-	err error
+	x       interface{}
+	err     error
+	gen     uint64    // generation of the cache when the entry was stored
+	created time.Time // when the entry was fetched
 }
 
 // Option is the type of option passed to the constructor.
@@ -109,6 +234,27 @@ func WithTTL(t time.Duration) Option {
 	}
 }
 
+// WithTTLJitter removes a random part of the TTL of each positive entry, up to the given
+// fraction of the TTL (0.1 means up to 10%), so that entries created together don't expire together.
+// Default: 0
+func WithTTLJitter(fraction float64) Option {
+	return func(c *Cache) {
+		c.ttlJitter = fraction
+	}
+}
+
+// WithEarlyRefresh enables the probabilistic early refresh of positive entries (XFetch).
+// An entry is refreshed before it expires with a probability growing as its expiration gets
+// closer and as it gets more expensive to compute, which favors popular and costly entries.
+// The cost of an entry is the time taken by its Fetcher. A beta > 1 favors earlier refreshes,
+// 0 disables them.
+// Default: 0
+func WithEarlyRefresh(beta float64) Option {
+	return func(c *Cache) {
+		c.earlyBeta = beta
+	}
+}
+
 // WithNegSize sets the size of the negative cache, used for storing errors and invalid objects.
 // Default: 500
 func WithNegSize(n int32) Option {
@@ -175,6 +321,25 @@ func WithStaleValidator(f func(interface{}, time.Duration) bool) Option {
 	}
 }
 
+// WithCodec sets the codec used to serialise values for snapshots and for the backend.
+// Default: BytesCodec{}
+func WithCodec(codec Codec) Option {
+	return func(c *Cache) {
+		c.codec = codec
+	}
+}
+
+// WithSnapshot sets the file used to store the positive entries and how often it is written.
+// The snapshot is also written by Close(). An empty path disables snapshots,
+// a zero interval disables periodic writes.
+// Default: "", 0
+func WithSnapshot(path string, interval time.Duration) Option {
+	return func(c *Cache) {
+		c.snapshotPath = path
+		c.snapshotInterval = interval
+	}
+}
+
 // New builds a cache given some options.
 func New(opts ...Option) (*Cache, error) {
 	c := &Cache{
@@ -188,6 +353,9 @@ func New(opts ...Option) (*Cache, error) {
 		staleQueueSize: 1000,
 		maxFetchers:    100,
 		canUseStale:    true,
+		codec:          BytesCodec{},
+		backendRetry:   5 * time.Second,
+		backendSweep:   10 * time.Minute,
 	}
 
 	for _, o := range opts {
@@ -204,7 +372,8 @@ func New(opts ...Option) (*Cache, error) {
 	}
 
 	c.posCache = ccache.New(ccache.Configure().
-		MaxSize(int64(c.posSize)).ItemsToPrune(uint32(c.posPruneSize)))
+		MaxSize(int64(c.posSize)).ItemsToPrune(uint32(c.posPruneSize)).
+		OnDelete(c.onPosDelete))
 	c.negCache = ccache.New(ccache.Configure().
 		MaxSize(int64(c.posSize)).ItemsToPrune(uint32(c.posPruneSize)))
 
@@ -219,6 +388,22 @@ func New(opts ...Option) (*Cache, error) {
 	for i := 0; i < c.staleFetchers; i++ {
 		go c.staleFetcher()
 	}
+
+	// for invalidation and snapshots
+	c.keys = make(map[string]*posCacheEntry)
+	c.tags = make(map[string]map[string]struct{})
+
+	// for snapshots and the backend sweep
+	c.stop = make(chan struct{})
+	if c.snapshotPath != "" && c.snapshotInterval > 0 {
+		go c.snapshotter()
+	}
+
+	// for the backend
+	c.pendingDeletes = make(map[string]struct{})
+	if s, ok := c.backend.(Sweeper); ok && c.backendSweep > 0 {
+		go c.backendSweeper(s)
+	}
 	return c, nil
 }
 
@@ -233,12 +418,29 @@ func New(opts ...Option) (*Cache, error) {
 //
 // An asynchronous fetch will happen if the entry is stale.
 func (c *Cache) Fetch(key string, f Fetcher) (interface{}, error) {
+	return c.FetchResult(key, f.toResult())
+}
+
+// FetchResult is like Fetch() with a ResultFetcher, which can set the TTL and the tags of the entry.
+func (c *Cache) FetchResult(key string, f ResultFetcher) (interface{}, error) {
+	item, _, err := c.FetchInfo(key, f)
+	return item, err
+}
+
+// FetchInfo is like FetchResult() and also tells how the value has been obtained:
+// from the cache (fresh, stale or negative entry) or fetched for this request.
+func (c *Cache) FetchInfo(key string, f ResultFetcher) (interface{}, Info, error) {
+	return c.fetchInfo(key, f, true)
+}
+
+// fetchInfo implements FetchInfo(). If askPeers is false, a missing key is never asked to its owner.
+func (c *Cache) fetchInfo(key string, f ResultFetcher, askPeers bool) (interface{}, Info, error) {
 	atomic.AddUint64(&c.requests, 1)
-	item, cached, err := c.tryCache(key, f)
+	item, info, cached, err := c.tryCache(key, f)
 	if cached {
 		atomic.AddUint64(&c.hits, 1)
 		// fresh or stale
-		return item, err
+		return item, info, err
 	}
 
 	// entry not in cache
@@ -248,13 +450,25 @@ func (c *Cache) Fetch(key string, f Fetcher) (interface{}, error) {
 		// nobody is fetching it yet, let's do it
 		c.fetching[key] = struct{}{}
 		c.fetchLock.Unlock()
+		if item, info, found := c.backendGet(key, time.Time{}); found {
+			c.endFetch(key)
+			c.fetchCond.Broadcast()
+			return item, info, nil
+		}
+		if askPeers {
+			if item, info, found := c.peerGet(key, time.Time{}); found {
+				c.endFetch(key)
+				c.fetchCond.Broadcast()
+				return item, info, nil
+			}
+		}
 		c.fetchLimiter <- struct{}{}
 		atomic.AddUint64(&c.newFetches, 1)
-		item, err = c.cacheItem(key, f)
+		item, info, err = c.cacheItem(key, f)
 		<-c.fetchLimiter
 		c.endFetch(key)
 		c.fetchCond.Broadcast()
-		return item, err
+		return item, info, err
 	}
 	// wait for the fetcher to finish
 	for {
@@ -267,75 +481,170 @@ func (c *Cache) Fetch(key string, f Fetcher) (interface{}, error) {
 	c.fetchLock.Unlock()
 
 	// get the hopefully newly cached entry
-	item, cached, err = c.tryCache(key, f)
+	item, info, cached, err = c.tryCache(key, f)
 	if cached {
-		return item, err
+		return item, info, err
 	}
 	// last resort (if too small a cache)
 	c.fetchLimiter <- struct{}{}
-	item, _, err = f()
+	res, err := c.call(key, f)
 	<-c.fetchLimiter
-	return item, err
+	return res.Value, Info{Status: StatusMiss}, err
+}
+
+// Warm fetches an entry ahead of requests if it is missing or expired.
+//
+// It shares the cache locking and the concurrency limit of Fetch(), but never waits for them:
+// it returns false without fetching if the entry is fresh, is already being fetched,
+// or if all the fetchers are busy serving requests.
+func (c *Cache) Warm(key string, f ResultFetcher) (bool, error) {
+	if item := c.posCache.Get(key); item != nil && !item.Expired() && c.current(item.Value().(*posCacheEntry).gen) {
+		return false, nil
+	}
+
+	c.fetchLock.Lock()
+	if _, fetching := c.fetching[key]; fetching {
+		c.fetchLock.Unlock()
+		return false, nil
+	}
+	select {
+	case c.fetchLimiter <- struct{}{}:
+	default:
+		c.fetchLock.Unlock()
+		return false, nil
+	}
+	c.fetching[key] = struct{}{}
+	c.fetchLock.Unlock()
+
+	atomic.AddUint64(&c.warmFetches, 1)
+	_, _, err := c.cacheItem(key, f)
+	<-c.fetchLimiter
+	c.endFetch(key)
+	c.fetchCond.Broadcast()
+	return true, err
 }
 
 // tryCache tries to find the given key in the positive and negative caches.
 // If an element is expired, it will be queued for async fetch and its stale
 // version will be returned immediately.
 // The boolean in the return value indicates if the key has been found in cache.
-func (c *Cache) tryCache(key string, f Fetcher) (interface{}, bool, error) {
+func (c *Cache) tryCache(key string, f ResultFetcher) (interface{}, Info, bool, error) {
 	item := c.posCache.Get(key)
+	if item != nil && !c.current(item.Value().(*posCacheEntry).gen) {
+		// purged entry
+		c.posCache.Delete(key)
+		item = nil
+	}
 	if item != nil {
 		valid := true
+		pe := item.Value().(*posCacheEntry)
 		if item.Expired() {
 			// stale item, let's enqueue a refresh
-			c.enqueueFetch(key, f)
+			c.enqueueFetch(fetchReq{key: key, f: f, created: pe.created})
 			if !c.useStale(item) {
 				valid = false
 			}
+		} else if c.refreshEarly(pe.delta, item.TTL()) {
+			// fresh item close to its expiration, refresh it before it expires
+			if c.enqueueFetch(fetchReq{key: key, f: f, early: true, created: pe.created}) {
+				atomic.AddUint64(&c.earlyFetches, 1)
+			}
 		}
 		if valid { // not expired or can use stale
-			return item.Value(), true, nil
+			return pe.x, itemInfo(item, pe.created), true, nil
 		}
 		// if cannot use stale
-		return nil, false, nil
+		return nil, Info{}, false, nil
 	}
 
 	item = c.negCache.Get(key)
 	if item != nil {
+		ne := item.Value().(*negCacheEntry)
+		if !c.current(ne.gen) {
+			// purged entry
+			c.negCache.Delete(key)
+			return nil, Info{}, false, nil
+		}
 		if item.Expired() {
 			// stale negative, remove it from cache
 			c.negCache.Delete(key)
 		}
-		ne := item.Value().(*negCacheEntry)
-		return ne.x, true, ne.err
+		info := itemInfo(item, ne.created)
+		info.Status = StatusNegative
+		return ne.x, info, true, ne.err
 	}
-	return nil, false, nil
+	return nil, Info{}, false, nil
 }
 
-// enqueueFetch puts a fetch request in the queue.
+// itemInfo describes a cached item fetched at the given time.
+func itemInfo(item *ccache.Item, created time.Time) Info {
+	info := Info{Status: StatusHit, Age: time.Since(created), TTL: item.TTL()}
+	if item.Expired() {
+		info.Status = StatusStale
+		info.TTL = 0
+	}
+	return info
+}
+
+// enqueueFetch puts a fetch request in the queue and returns true if it has been queued.
 // It does nothing if the request is already in the queue, or if the queue is full.
-func (c *Cache) enqueueFetch(key string, f Fetcher) {
+func (c *Cache) enqueueFetch(fr fetchReq) bool {
+	queued := false
 	c.queuedLock.Lock()
-	_, ok := c.queued[key]
+	_, ok := c.queued[fr.key]
 	if !ok {
 		select {
-		case c.fetchQueue <- fetchReq{key, f}:
-			c.queued[key] = struct{}{}
+		case c.fetchQueue <- fr:
+			c.queued[fr.key] = struct{}{}
+			queued = true
 		default:
 			// drop request on full queue instead of blocking
 		}
 	}
 	c.queuedLock.Unlock()
+	return queued
+}
+
+// refreshEarly decides if a fresh entry is refreshed now, following the XFetch algorithm:
+// refresh if -delta * beta * ln(rand()) >= remaining TTL.
+func (c *Cache) refreshEarly(delta, ttl time.Duration) bool {
+	if c.earlyBeta <= 0 || delta <= 0 {
+		return false
+	}
+	// 1 - rand.Float64() is in (0, 1], avoiding ln(0)
+	gap := -float64(delta) * c.earlyBeta * math.Log(1-rand.Float64())
+	return gap >= float64(ttl)
+}
+
+// jitter returns the TTL of a new positive entry.
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.ttlJitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(rand.Float64()*c.ttlJitter*float64(ttl))
 }
 
 // staleFetcher grabs a fetch request from the chan and executes it.
 // Requests are guaranteed to be unique in the queue (using "queued" map): no need to protect
 // against multiple concurrent fetches, no need to use cache locking.
+// An expired entry may have been refreshed by another replica already: a newer entry of the
+// backend or of the peers is used instead. An early refresh always fetches, since the backend
+// holds the same entry until it expires.
 func (c *Cache) staleFetcher() {
 	for fr := range c.fetchQueue {
+		if !fr.early {
+			if _, _, found := c.backendGet(fr.key, fr.created); found {
+				c.endQueuing(fr.key)
+				continue
+			}
+			if _, _, found := c.peerGet(fr.key, fr.created); found {
+				c.endQueuing(fr.key)
+				continue
+			}
+		}
 		// fetch it
 		atomic.AddUint64(&c.staleFetches, 1)
-		_, _ = c.cacheItem(fr.key, fr.f)
+		_, _, _ = c.cacheItem(fr.key, fr.f)
 		c.endQueuing(fr.key)
 	}
 }
@@ -343,22 +652,155 @@ func (c *Cache) staleFetcher() {
 // cacheItem fetches an object using the supplied closure and stores it
 // in cache using the supplied key. Depending on the error and validity returned by
 // the closure, the entry will end in either the positive or the negative cache.
-// if error not nil, store in negative cache (but keep positive entry);
+// if error is a TransientError, store nothing;
+// else if error not nil, store in negative cache (but keep positive entry);
 // else if validity is false, store in negative cache and delete positive entry;
 // else (error nil and validity true) store in positive cache and remove neg entry
-func (c *Cache) cacheItem(key string, f Fetcher) (interface{}, error) {
-	item, valid, err := f()
-
-	if err != nil {
-		c.negCache.Set(key, &negCacheEntry{item, err}, c.negTTL)
-	} else if !valid {
-		c.negCache.Set(key, &negCacheEntry{item, err}, c.negTTL)
-		c.posCache.Delete(key)
+// The TTL of the Result, if any, replaces the TTL of the cache.
+func (c *Cache) cacheItem(key string, f ResultFetcher) (interface{}, Info, error) {
+	// an entry computed while the cache is purged is dropped
+	gen := atomic.LoadUint64(&c.generation)
+	start := time.Now()
+	res, err := c.call(key, f)
+	delta := time.Since(start)
+	info := Info{Status: StatusMiss}
+
+	var transient *TransientError
+	if errors.As(err, &transient) {
+		return res.Value, info, err
+	} else if err != nil {
+		info.TTL = c.entryTTL(res.TTL, c.negTTL)
+		c.negCache.Set(key, &negCacheEntry{res.Value, err, gen, start}, info.TTL)
+	} else if !res.Valid {
+		info.TTL = c.entryTTL(res.TTL, c.negTTL)
+		c.negCache.Set(key, &negCacheEntry{res.Value, err, gen, start}, info.TTL)
+		c.deletePos(key)
+		c.backendDelete(key)
 	} else {
-		c.posCache.Set(key, item, c.posTTL)
+		info.TTL = c.jitter(c.entryTTL(res.TTL, c.posTTL))
+		pe := &posCacheEntry{key: key, x: res.Value, delta: delta, tags: res.Tags, gen: gen, created: start}
+		c.setPos(pe, info.TTL)
+		c.backendSet(pe, info.TTL)
 		c.negCache.Delete(key)
 	}
-	return item, err
+	return res.Value, info, err
+}
+
+// entryTTL returns the TTL of an entry, or the default one if not set.
+func (c *Cache) entryTTL(ttl, def time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+	return def
+}
+
+// setPos indexes an entry and stores it in the positive cache.
+// The index is updated first so that an early eviction of the entry is not missed by onPosDelete.
+func (c *Cache) setPos(pe *posCacheEntry, ttl time.Duration) {
+	pe.expires = time.Now().Add(ttl)
+
+	c.indexLock.Lock()
+	c.unindex(pe.key)
+	c.keys[pe.key] = pe
+	for _, tag := range pe.tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][pe.key] = struct{}{}
+	}
+	c.indexLock.Unlock()
+
+	c.posCache.Set(pe.key, pe, ttl)
+}
+
+// deletePos removes an item from the positive cache and from the index.
+func (c *Cache) deletePos(key string) {
+	c.indexLock.Lock()
+	c.unindex(key)
+	c.indexLock.Unlock()
+
+	c.posCache.Delete(key)
+}
+
+// onPosDelete is called by ccache when an entry is evicted or replaced in the positive cache.
+// The entry is removed from the index unless it has been replaced by a newer one.
+// It must not call ccache, as it runs in its worker goroutine.
+func (c *Cache) onPosDelete(item *ccache.Item) {
+	pe, ok := item.Value().(*posCacheEntry)
+	if !ok {
+		return
+	}
+	c.indexLock.Lock()
+	if c.keys[pe.key] == pe {
+		c.unindex(pe.key)
+	}
+	c.indexLock.Unlock()
+}
+
+// unindex removes a key and its tags from the index. indexLock must be held.
+func (c *Cache) unindex(key string) {
+	pe, ok := c.keys[key]
+	if !ok {
+		return
+	}
+	for _, tag := range pe.tags {
+		delete(c.tags[tag], key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	delete(c.keys, key)
+}
+
+// current tells if an entry stored at the given generation has not been purged.
+func (c *Cache) current(gen uint64) bool {
+	return gen == atomic.LoadUint64(&c.generation)
+}
+
+// Invalidate removes an entry from the positive and negative caches, and from the backend.
+func (c *Cache) Invalidate(key string) {
+	c.deletePos(key)
+	c.negCache.Delete(key)
+	c.backendDelete(key)
+}
+
+// InvalidateTag removes every positive entry having the given tag, and returns
+// the number of entries removed.
+func (c *Cache) InvalidateTag(tag string) int {
+	c.indexLock.Lock()
+	keys := make([]string, 0, len(c.tags[tag]))
+	for key := range c.tags[tag] {
+		keys = append(keys, key)
+	}
+	c.indexLock.Unlock()
+
+	for _, key := range keys {
+		c.Invalidate(key)
+	}
+	return len(keys)
+}
+
+// Purge removes every entry from the positive and negative caches.
+// Negative entries are dropped lazily, on their next lookup.
+// The entries of the backend written before the purge are ignored, and deleted on their next lookup.
+func (c *Cache) Purge() {
+	atomic.StoreInt64(&c.purgedAt, time.Now().UnixNano())
+	atomic.AddUint64(&c.generation, 1)
+
+	c.indexLock.Lock()
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	c.keys = make(map[string]*posCacheEntry)
+	c.tags = make(map[string]map[string]struct{})
+	c.indexLock.Unlock()
+
+	for _, key := range keys {
+		if item := c.posCache.Get(key); item != nil && !c.current(item.Value().(*posCacheEntry).gen) {
+			c.posCache.Delete(key)
+		}
+	}
 }
 
 // endQueuing marks an item as not being in the fetch queue anymore.
@@ -384,11 +826,23 @@ func (c *Cache) useStale(item *ccache.Item) bool {
 	}
 	if c.staleValidator != nil {
 		// ccache gives a negative TTL for expired items, inverse it
-		return c.staleValidator(item.Value(), -item.TTL())
+		return c.staleValidator(item.Value().(*posCacheEntry).x, -item.TTL())
 	}
 	return true
 }
 
+// Close stops the periodic snapshots and writes a last snapshot if enabled.
+func (c *Cache) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	if c.snapshotPath == "" {
+		return nil
+	}
+	_, err := c.SaveSnapshot()
+	return err
+}
+
 // Hits returns the number of cache hits since start.
 func (c *Cache) Hits() uint64 {
 	return atomic.LoadUint64(&c.hits)
@@ -408,3 +862,13 @@ func (c *Cache) NewFetches() uint64 {
 func (c *Cache) StaleFetches() uint64 {
 	return atomic.LoadUint64(&c.staleFetches)
 }
+
+// EarlyFetches returns the number of refreshes queued before expiration, since start.
+func (c *Cache) EarlyFetches() uint64 {
+	return atomic.LoadUint64(&c.earlyFetches)
+}
+
+// WarmFetches returns the number of fetches done by Warm(), since start.
+func (c *Cache) WarmFetches() uint64 {
+	return atomic.LoadUint64(&c.warmFetches)
+}
@@ -0,0 +1,288 @@
+package xcache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWarm(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached []string // keys fetched before the warm-up
+		busy   string   // key fetched by a blocked fetcher during the warm-up, if not empty
+		key    string
+		want   bool
+	}{
+		{
+			name: "missing entry",
+			key:  "missing",
+			want: true,
+		},
+		{
+			name:   "fresh entry",
+			cached: []string{"fresh"},
+			key:    "fresh",
+		},
+		{
+			name: "entry being fetched",
+			busy: "busy",
+			key:  "busy",
+		},
+		{
+			name: "every fetcher busy",
+			busy: "busy",
+			key:  "missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := New(WithFetchers(1))
+			defer c.Close()
+			for _, key := range tt.cached {
+				c.Fetch(key, func() (interface{}, bool, error) { return "value", true, nil })
+			}
+			if tt.busy != "" {
+				started, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+				go func() {
+					c.Fetch(tt.busy, func() (interface{}, bool, error) {
+						close(started)
+						<-release
+						return "value", true, nil
+					})
+					close(done)
+				}()
+				<-started
+				defer func() {
+					close(release)
+					<-done
+				}()
+			}
+
+			fetched := false
+			warmed, err := c.Warm(tt.key, func() (Result, error) {
+				fetched = true
+				return Result{Value: "warm", Valid: true}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if warmed != tt.want || fetched != tt.want {
+				t.Fatalf("want warmed and fetched %t, have %t and %t", tt.want, warmed, fetched)
+			}
+			want := uint64(0)
+			if tt.want {
+				want = 1
+			}
+			if have := c.WarmFetches(); have != want {
+				t.Fatalf("want %d warm fetches, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const ttl = time.Minute
+	tests := []struct {
+		name     string
+		fraction float64
+		min      time.Duration
+	}{
+		{name: "disabled", fraction: 0, min: ttl},
+		{name: "10%", fraction: 0.1, min: ttl - ttl/10},
+		{name: "50%", fraction: 0.5, min: ttl / 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := New(WithTTLJitter(tt.fraction))
+			defer c.Close()
+			seen := map[time.Duration]struct{}{}
+			for i := 0; i < 1000; i++ {
+				have := c.jitter(ttl)
+				if have < tt.min || have > ttl {
+					t.Fatalf("want a TTL in [%s, %s], have %s", tt.min, ttl, have)
+				}
+				seen[have] = struct{}{}
+			}
+			if spread := len(seen) > 1; spread != (tt.fraction > 0) {
+				t.Fatalf("want TTLs spread %t, have %d distinct TTLs", tt.fraction > 0, len(seen))
+			}
+		})
+	}
+}
+
+func TestRefreshEarly(t *testing.T) {
+	tests := []struct {
+		name  string
+		beta  float64
+		delta time.Duration // time taken by the fetcher
+		ttl   time.Duration // remaining TTL
+		want  bool
+	}{
+		{name: "disabled", beta: 0, delta: time.Second, ttl: time.Millisecond},
+		{name: "unknown cost", beta: 1e6, delta: 0, ttl: time.Millisecond},
+		{name: "cheap entry far from its expiration", beta: 1, delta: time.Millisecond, ttl: time.Hour},
+		{name: "costly entry close to its expiration", beta: 1e6, delta: time.Second, ttl: time.Millisecond, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := New(WithEarlyRefresh(tt.beta))
+			defer c.Close()
+			for i := 0; i < 1000; i++ {
+				if have := c.refreshEarly(tt.delta, tt.ttl); have != tt.want {
+					t.Fatalf("want refresh %t, have %t", tt.want, have)
+				}
+			}
+		})
+	}
+}
+
+func TestEarlyFetch(t *testing.T) {
+	c, _ := New(WithEarlyRefresh(1e6), WithTTL(time.Minute))
+	defer c.Close()
+	fetches := make(chan struct{}, 2)
+	fetch := func() (Result, error) {
+		time.Sleep(5 * time.Millisecond)
+		fetches <- struct{}{}
+		return Result{Value: "value", Valid: true}, nil
+	}
+	c.FetchInfo("key", fetch)
+	<-fetches
+
+	_, info, err := c.FetchInfo("key", fetch)
+	if err != nil || info.Status != StatusHit {
+		t.Fatalf("want the fresh entry returned, have %s, %v", info.Status, err)
+	}
+	select {
+	case <-fetches:
+	case <-time.After(time.Second):
+		t.Fatal("want the entry refreshed early")
+	}
+	if have := c.EarlyFetches(); have != 1 {
+		t.Fatalf("want 1 early fetch, have %d", have)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	tags := map[string][]string{
+		"a": {"red"},
+		"b": {"red", "blue"},
+		"c": {"blue"},
+	}
+	tests := []struct {
+		name    string
+		op      func(c *Cache) int // returns the number of entries removed, or -1 if not known
+		removed int
+		fetched []string // keys fetched again
+	}{
+		{
+			name:    "key",
+			op:      func(c *Cache) int { c.Invalidate("a"); return -1 },
+			removed: -1,
+			fetched: []string{"a"},
+		},
+		{
+			name:    "missing key",
+			op:      func(c *Cache) int { c.Invalidate("missing"); return -1 },
+			removed: -1,
+		},
+		{
+			name:    "tag",
+			op:      func(c *Cache) int { return c.InvalidateTag("red") },
+			removed: 2,
+			fetched: []string{"a", "b"},
+		},
+		{
+			name:    "missing tag",
+			op:      func(c *Cache) int { return c.InvalidateTag("green") },
+			removed: 0,
+		},
+		{
+			name:    "purge",
+			op:      func(c *Cache) int { c.Purge(); return -1 },
+			removed: -1,
+			fetched: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := New()
+			defer c.Close()
+			var fetched []string
+			fetch := func(key string) ResultFetcher {
+				return func() (Result, error) {
+					fetched = append(fetched, key)
+					return Result{Value: "value:" + key, Valid: true, Tags: tags[key]}, nil
+				}
+			}
+			for _, key := range []string{"a", "b", "c"} {
+				c.FetchInfo(key, fetch(key))
+			}
+			c.Fetch("negative", func() (interface{}, bool, error) { return nil, false, nil })
+
+			if have := tt.op(c); have != tt.removed {
+				t.Fatalf("want %d entries removed, have %d", tt.removed, have)
+			}
+
+			fetched = nil
+			for _, key := range []string{"a", "b", "c"} {
+				x, _, err := c.FetchInfo(key, fetch(key))
+				if err != nil || x != "value:"+key {
+					t.Fatalf("bad entry %q, have %v, %v", key, x, err)
+				}
+			}
+			if fmt.Sprint(fetched) != fmt.Sprint(tt.fetched) {
+				t.Fatalf("want %v fetched again, have %v", tt.fetched, fetched)
+			}
+			c.indexLock.Lock()
+			red := c.tags["red"]
+			c.indexLock.Unlock()
+			if !reflect.DeepEqual(red, map[string]struct{}{"a": {}, "b": {}}) {
+				t.Fatalf("want the tags indexed again, have %v", red)
+			}
+
+			negative := false
+			c.Fetch("negative", func() (interface{}, bool, error) { negative = true; return nil, false, nil })
+			if want := tt.name == "purge"; negative != want {
+				t.Fatalf("want the negative entry fetched again %t, have %t", want, negative)
+			}
+		})
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		fetches int
+	}{
+		{name: "error", err: errors.New("failed"), fetches: 1},
+		{name: "transient error", err: Transient(errors.New("overloaded")), fetches: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := New()
+			defer c.Close()
+			fetches := 0
+			fetch := func() (Result, error) {
+				fetches++
+				return Result{}, tt.err
+			}
+			for i := 0; i < 2; i++ {
+				if _, _, err := c.FetchInfo("key", fetch); !errors.Is(err, tt.err) {
+					t.Fatalf("want error %v, have %v", tt.err, err)
+				}
+			}
+			if fetches != tt.fetches {
+				t.Fatalf("want %d fetches, have %d", tt.fetches, fetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package logger
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ErrSyncTimeout is returned by AsyncWriter.Sync when the buffered messages aren't sent in time.
+var ErrSyncTimeout = errors.New("log messages not sent before the sync timeout")
+
+// AsyncWriter sends the messages to an underlying writer from a background goroutine, so that
+// logging doesn't wait for the network. The messages are kept in a ring buffer, the oldest
+// ones being dropped when it is full, and sent by batches.
+type AsyncWriter struct {
+	w           io.Writer
+	size        int
+	batchSize   int
+	interval    time.Duration
+	syncTimeout time.Duration
+	stats       *Stats
+
+	lock   sync.Mutex // guard access to "ring", "head", "count" and "closed"
+	ring   [][]byte
+	head   int // index of the oldest message
+	count  int
+	closed bool
+
+	notify chan struct{}      // a batch is full
+	flush  chan chan struct{} // Sync asks for the buffered messages, closing the channel once sent
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// AsyncOption is the type of option passed to NewAsyncWriter and WithAsync.
+type AsyncOption func(a *AsyncWriter)
+
+// WithRingSize sets the number of messages waiting to be sent.
+// Default: 10000
+func WithRingSize(size int) AsyncOption {
+	return func(a *AsyncWriter) {
+		if size > 0 {
+			a.size = size
+		}
+	}
+}
+
+// WithBatch sets the number of messages sent at once, and the maximum time a message waits
+// for its batch to be full.
+// Default: 100, 200ms
+func WithBatch(size int, interval time.Duration) AsyncOption {
+	return func(a *AsyncWriter) {
+		if size > 0 {
+			a.batchSize = size
+		}
+		if interval > 0 {
+			a.interval = interval
+		}
+	}
+}
+
+// WithSyncTimeout sets the maximum time Sync waits for the buffered messages to be sent.
+// Default: 2s
+func WithSyncTimeout(d time.Duration) AsyncOption {
+	return func(a *AsyncWriter) {
+		if d > 0 {
+			a.syncTimeout = d
+		}
+	}
+}
+
+// WithAsyncStats sets the counters incremented by the messages dropped from the ring.
+// Default: counters private to the writer
+func WithAsyncStats(s *Stats) AsyncOption {
+	return func(a *AsyncWriter) {
+		if s != nil {
+			a.stats = s
+		}
+	}
+}
+
+// NewAsyncWriter starts sending in the background the messages written to w.
+func NewAsyncWriter(w io.Writer, opts ...AsyncOption) *AsyncWriter {
+	a := &AsyncWriter{
+		w:           w,
+		size:        10000,
+		batchSize:   100,
+		interval:    200 * time.Millisecond,
+		syncTimeout: 2 * time.Second,
+		stats:       &Stats{},
+		notify:      make(chan struct{}, 1),
+		flush:       make(chan chan struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(a)
+	}
+	a.ring = make([][]byte, a.size)
+
+	go a.run()
+	return a
+}
+
+// Write implements io.Writer. It never blocks on the underlying writer: the message is
+// copied, the caller reusing buf.
+func (a *AsyncWriter) Write(buf []byte) (int, error) {
+	msg := append(make([]byte, 0, len(buf)), buf...)
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		atomic.AddUint64(&a.stats.dropped, 1)
+		return len(buf), nil
+	}
+	if a.count == a.size {
+		a.ring[a.head] = nil
+		a.head = (a.head + 1) % a.size
+		a.count--
+		atomic.AddUint64(&a.stats.dropped, 1)
+	}
+	a.ring[(a.head+a.count)%a.size] = msg
+	a.count++
+	full := a.count >= a.batchSize
+	a.lock.Unlock()
+
+	if full {
+		select {
+		case a.notify <- struct{}{}:
+		default:
+		}
+	}
+	return len(buf), nil
+}
+
+// Sync implements WriteSyncer: it waits for the buffered messages to be sent, at most the
+// sync timeout, then syncs the underlying writer.
+func (a *AsyncWriter) Sync() error {
+	timer := time.NewTimer(a.syncTimeout)
+	defer timer.Stop()
+
+	sent := make(chan struct{})
+	select {
+	case a.flush <- sent:
+	case <-a.done:
+		close(sent)
+	case <-timer.C:
+		return ErrSyncTimeout
+	}
+	select {
+	case <-sent:
+	case <-timer.C:
+		return ErrSyncTimeout
+	}
+
+	if s, ok := a.w.(zapcore.WriteSyncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close sends the buffered messages and stops the background goroutine. The messages written
+// afterwards are dropped.
+func (a *AsyncWriter) Close() error {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.lock.Unlock()
+
+	close(a.stop)
+	<-a.done
+	return nil
+}
+
+// run sends a batch when it is full or every interval, and everything on Sync and Close.
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, a.batchSize)
+	for {
+		select {
+		case <-a.notify:
+			batch = a.send(batch, false)
+		case <-ticker.C:
+			batch = a.send(batch, true)
+		case sent := <-a.flush:
+			batch = a.send(batch, true)
+			close(sent)
+		case <-a.stop:
+			a.send(batch, true)
+			return
+		}
+	}
+}
+
+// send writes the full batches, and the last partial one if all is set.
+func (a *AsyncWriter) send(batch [][]byte, all bool) [][]byte {
+	for {
+		a.lock.Lock()
+		if a.count == 0 || (!all && a.count < a.batchSize) {
+			a.lock.Unlock()
+			return batch
+		}
+		for len(batch) < a.batchSize && a.count > 0 {
+			batch = append(batch, a.ring[a.head])
+			a.ring[a.head] = nil
+			a.head = (a.head + 1) % a.size
+			a.count--
+		}
+		a.lock.Unlock()
+
+		// the errors are counted by the underlying writer
+		for i, msg := range batch {
+			a.w.Write(msg)
+			batch[i] = nil
+		}
+		batch = batch[:0]
+	}
+}
@@ -2,38 +2,51 @@ package logger
 
 import (
 	"context"
+	"sync"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// ctxLogger is the logger of a request. Its fields may be added concurrently by the
+// handlers of the request.
 type ctxLogger struct {
 	logger *zap.Logger
+	lock   sync.Mutex
 	fields []zapcore.Field
 }
 
-const ctxMarkerKey = "zap-graylog.logger"
+type ctxMarker struct{}
+
+var ctxMarkerKey = ctxMarker{}
 
 var nullLogger = zap.NewNop()
 
+// AddFields adds fields to the logger carried by ctx, for every later call to WithContext
+// with ctx or a context derived from it.
 func AddFields(ctx context.Context, fields ...zapcore.Field) {
 	l, ok := ctx.Value(ctxMarkerKey).(*ctxLogger)
 	if !ok || l == nil {
 		return
 	}
+	l.lock.Lock()
 	l.fields = append(l.fields, fields...)
-
+	l.lock.Unlock()
 }
 
+// WithContext returns the logger carried by ctx with the added fields, or a no-op logger.
 func WithContext(ctx context.Context) *zap.Logger {
 	l, ok := ctx.Value(ctxMarkerKey).(*ctxLogger)
 	if !ok || l == nil {
 		return nullLogger
 	}
 
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	return l.logger.With(l.fields...)
 }
 
+// ToContext returns a copy of ctx carrying logger.
 func ToContext(ctx context.Context, logger *zap.Logger) context.Context {
 	l := &ctxLogger{
 		logger: logger,
@@ -1,34 +1,49 @@
 package logger
 
 import (
+	"os"
+
 	"go.uber.org/zap/buffer"
 	"go.uber.org/zap/zapcore"
 )
 
+// gelfVersion is the version of the GELF specs followed by the encoder.
+const gelfVersion = "1.1"
+
 // GELFEncoder is a gelf encoder.
 // It will use an underlying json encoder to encode entries to the gelf format.
 // See http://docs.graylog.org/en/2.4/pages/gelf.html.
 type GELFEncoder struct {
 	zapcore.Encoder
+	host string
 }
 
 // Clone implements the encoder interface.
 func (e GELFEncoder) Clone() zapcore.Encoder {
-	return &GELFEncoder{e.Encoder.Clone()}
+	return &GELFEncoder{Encoder: e.Encoder.Clone(), host: e.host}
 }
 
-// EncodeEntry escape the keys following the gelf spec, then the underlying encoder will encode the entry.
+// EncodeEntry escape the keys following the gelf spec, adds the mandatory "version" and "host"
+// fields, then the underlying encoder will encode the entry.
 func (e GELFEncoder) EncodeEntry(entry zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
-	for i, f := range fields {
-		fields[i].Key = escapeKey(f.Key)
-	}
-	return e.Encoder.EncodeEntry(entry, fields)
+	all := make([]zapcore.Field, 0, len(fields)+2)
+	all = append(all,
+		zapcore.Field{Key: "version", Type: zapcore.StringType, String: gelfVersion},
+		zapcore.Field{Key: "host", Type: zapcore.StringType, String: e.host})
+	return e.Encoder.EncodeEntry(entry, append(all, escapeFields(fields)...))
 }
 
 // NewGELFEncoder instanciate a new GELFEncoder.
+// The host is the hostname of the machine, "unknown" if we cannot get it.
 func NewGELFEncoder() *GELFEncoder {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+
 	return &GELFEncoder{
-		zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		host: host,
+		Encoder: zapcore.NewJSONEncoder(zapcore.EncoderConfig{
 			TimeKey:        "timestamp",
 			NameKey:        "_logger",
 			LevelKey:       "level",
@@ -45,11 +60,33 @@ func NewGELFEncoder() *GELFEncoder {
 	}
 }
 
+// escapeFields returns a copy of the fields with their keys escaped, the fields of the caller
+// being shared with the other cores.
+func escapeFields(fields []zapcore.Field) []zapcore.Field {
+	escaped := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		f.Key = escapeKey(f.Key)
+		escaped[i] = f
+	}
+	return escaped
+}
+
+// gelfCore escapes the keys of the fields added with With, which the encoder adds to its
+// context without going through EncodeEntry.
+type gelfCore struct {
+	zapcore.Core
+}
+
+// With implements zapcore.Core.
+func (c gelfCore) With(fields []zapcore.Field) zapcore.Core {
+	return gelfCore{c.Core.With(escapeFields(fields))}
+}
+
 func escapeKey(key string) string {
 	switch key {
 	case "id":
 		return "__id"
-	case "version", "host", "short_message", "full_message", "timestamp", "level":
+	case "short_message", "full_message", "timestamp", "level":
 		return key
 	}
 
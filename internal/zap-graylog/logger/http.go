@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// levelRequest is the body of a PUT request changing the levels.
+type levelRequest struct {
+	Output    string `json:"output"`    // "" for every output
+	Component string `json:"component"` // "" for the level of the output
+	Level     string `json:"level"`     // "" to reset the level
+	TTL       string `json:"ttl"`       // duration such as "15m", "" for a permanent change
+}
+
+// ServeHTTP serves the levels on GET, and changes them on PUT with a JSON body such as
+// {"output": "graylog", "component": "http", "level": "DEBUG", "ttl": "15m"}.
+func (l *Levels) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req levelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := l.change(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.State())
+}
+
+func (l *Levels) change(req levelRequest) error {
+	var ttl time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("ttl must be positive, have %s", req.TTL)
+		}
+		ttl = d
+	}
+	var level Level
+	if req.Level != "" {
+		if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+			return err
+		}
+	}
+
+	outputs := []string{req.Output}
+	if req.Output == "" {
+		outputs = l.Outputs()
+	}
+	for _, output := range outputs {
+		var err error
+		if req.Level == "" {
+			err = l.Reset(output, req.Component)
+		} else {
+			err = l.Set(output, req.Component, zapcore.Level(level), ttl)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
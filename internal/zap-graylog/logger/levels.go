@@ -0,0 +1,243 @@
+package logger
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Outputs of the logger, whose levels are set separately.
+const (
+	OutputCLI     = "cli"
+	OutputGraylog = "graylog"
+)
+
+// ComponentKey is the key of the field naming the component of a logger, such as "http".
+// Its levels may be overridden.
+const ComponentKey = "component"
+
+// Levels holds the levels of the outputs of the logger, changed at runtime. A change may be
+// temporary, reverted after a TTL, and may only apply to the loggers of a component.
+type Levels struct {
+	initial map[string]zapcore.Level
+	atomic  map[string]zap.AtomicLevel
+
+	lock       sync.RWMutex                       // guard access to "temporary" and "components"
+	temporary  map[string]*levelChange            // temporary levels by output
+	components map[string]map[string]*levelChange // overrides by output and component
+	overrides  int32                              // number of overrides, read without the lock
+}
+
+// levelChange is a change of level, until expires unless it is zero.
+type levelChange struct {
+	level   zapcore.Level
+	expires time.Time
+	timer   *time.Timer
+	revert  zapcore.Level // level of the output before a temporary change
+}
+
+// NewLevels returns the levels of a logger sending to graylog at GraylogLevel and to the
+// console at CLILevel.
+func NewLevels(GraylogLevel, CLILevel Level) *Levels {
+	l := &Levels{
+		initial: map[string]zapcore.Level{
+			OutputCLI:     zapcore.Level(CLILevel),
+			OutputGraylog: zapcore.Level(GraylogLevel),
+		},
+		atomic:     map[string]zap.AtomicLevel{},
+		temporary:  map[string]*levelChange{},
+		components: map[string]map[string]*levelChange{},
+	}
+	for output, level := range l.initial {
+		l.atomic[output] = zap.NewAtomicLevelAt(level)
+		l.components[output] = map[string]*levelChange{}
+	}
+	return l
+}
+
+// Enabled reports whether the loggers of component log at lvl on output.
+func (l *Levels) Enabled(output, component string, lvl zapcore.Level) bool {
+	if component != "" && atomic.LoadInt32(&l.overrides) > 0 {
+		l.lock.RLock()
+		c := l.components[output][component]
+		l.lock.RUnlock()
+		if c != nil {
+			return lvl >= c.level
+		}
+	}
+	return l.atomic[output].Enabled(lvl)
+}
+
+// Set sets the level of output, or of the loggers of component on output if component isn't
+// empty. The change is reverted after ttl, unless ttl is 0.
+func (l *Levels) Set(output, component string, level zapcore.Level, ttl time.Duration) error {
+	if _, ok := l.atomic[output]; !ok {
+		return fmt.Errorf("unknown output %q", output)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	c := &levelChange{level: level}
+	if component == "" {
+		c.revert = l.atomic[output].Level()
+		if t := l.temporary[output]; t != nil {
+			// the temporary changes revert to the level set to last
+			t.timer.Stop()
+			c.revert = t.revert
+			delete(l.temporary, output)
+		}
+		l.atomic[output].SetLevel(level)
+		if ttl > 0 {
+			l.expireAfter(c, ttl, output, component)
+			l.temporary[output] = c
+		}
+		return nil
+	}
+
+	l.removeLocked(output, component)
+	if ttl > 0 {
+		l.expireAfter(c, ttl, output, component)
+	}
+	l.components[output][component] = c
+	atomic.AddInt32(&l.overrides, 1)
+	return nil
+}
+
+// Reset sets output back to its initial level, or removes the override of component on output
+// if component isn't empty.
+func (l *Levels) Reset(output, component string) error {
+	if component == "" {
+		return l.Set(output, "", l.initial[output], 0)
+	}
+	if _, ok := l.atomic[output]; !ok {
+		return fmt.Errorf("unknown output %q", output)
+	}
+
+	l.lock.Lock()
+	l.removeLocked(output, component)
+	l.lock.Unlock()
+	return nil
+}
+
+// removeLocked removes the override of component on output. The lock must be held.
+func (l *Levels) removeLocked(output, component string) {
+	c := l.components[output][component]
+	if c == nil {
+		return
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	delete(l.components[output], component)
+	atomic.AddInt32(&l.overrides, -1)
+}
+
+// expireAfter reverts the change c after ttl, unless it was replaced. The lock must be held.
+func (l *Levels) expireAfter(c *levelChange, ttl time.Duration, output, component string) {
+	c.expires = time.Now().Add(ttl)
+	c.timer = time.AfterFunc(ttl, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if component == "" {
+			if l.temporary[output] == c {
+				l.atomic[output].SetLevel(c.revert)
+				delete(l.temporary, output)
+			}
+			return
+		}
+		if l.components[output][component] == c {
+			l.removeLocked(output, component)
+		}
+	})
+}
+
+// LevelState is a level, and when it is reverted if it is temporary.
+type LevelState struct {
+	Level     string     `json:"level"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// OutputState is the level of an output, and the overrides of its components.
+type OutputState struct {
+	LevelState
+	Components map[string]LevelState `json:"components,omitempty"`
+}
+
+// State returns the levels of the outputs.
+func (l *Levels) State() map[string]OutputState {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	state := map[string]OutputState{}
+	for output, a := range l.atomic {
+		o := OutputState{LevelState: LevelState{Level: a.Level().CapitalString()}}
+		if t := l.temporary[output]; t != nil {
+			o.ExpiresAt = expiresAt(t)
+		}
+		for component, c := range l.components[output] {
+			if o.Components == nil {
+				o.Components = map[string]LevelState{}
+			}
+			o.Components[component] = LevelState{Level: c.level.CapitalString(), ExpiresAt: expiresAt(c)}
+		}
+		state[output] = o
+	}
+	return state
+}
+
+// Outputs returns the names of the outputs.
+func (l *Levels) Outputs() []string {
+	outputs := make([]string, 0, len(l.atomic))
+	for output := range l.atomic {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+func expiresAt(c *levelChange) *time.Time {
+	if c.expires.IsZero() {
+		return nil
+	}
+	t := c.expires.UTC()
+	return &t
+}
+
+// levelCore filters the entries of an output with the levels, the underlying core enabling
+// every level. It tracks the component of the logger from the fields added with With.
+type levelCore struct {
+	zapcore.Core
+	levels    *Levels
+	output    string
+	component string
+}
+
+// Enabled implements zapcore.Core.
+func (c levelCore) Enabled(lvl zapcore.Level) bool {
+	return c.levels.Enabled(c.output, c.component, lvl)
+}
+
+// With implements zapcore.Core.
+func (c levelCore) With(fields []zapcore.Field) zapcore.Core {
+	component := c.component
+	for _, f := range fields {
+		if f.Key == ComponentKey && f.Type == zapcore.StringType {
+			component = f.String
+		}
+	}
+	return levelCore{Core: c.Core.With(fields), levels: c.levels, output: c.output, component: component}
+}
+
+// Check implements zapcore.Core.
+func (c levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
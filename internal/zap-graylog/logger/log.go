@@ -9,40 +9,60 @@ import (
 )
 
 // NewLogger instanciate a new zap.Logger that will output to both console and graylog.
-// If GraylogEndpoint == "", no data will be send to graylog.
-func NewLogger(GraylogEndpoint string, GraylogLevel, CLILevel Level) (*zap.Logger, error) {
+// If GraylogEndpoint == "", no data will be send to graylog. The options configure the
+// writer to graylog, which sends in the background: Sync waits for the buffered messages.
+func NewLogger(GraylogEndpoint string, GraylogLevel, CLILevel Level, opts ...Option) (*zap.Logger, error) {
+	return New(GraylogEndpoint, NewLevels(GraylogLevel, CLILevel), opts...)
+}
+
+// New is NewLogger with levels changed at runtime.
+func New(GraylogEndpoint string, levels *Levels, opts ...Option) (*zap.Logger, error) {
 	c := zap.NewProductionConfig()
-	c.Level = zap.NewAtomicLevelAt(zapcore.Level(CLILevel))
+	// the levels filter the entries, the cores enable them all
+	c.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
 	log, err := c.Build()
 	if err != nil {
 		return nil, err
 	}
 
 	if GraylogEndpoint == "" {
-		return log, nil
+		return log.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+			return levelCore{Core: withHost(c), levels: levels, output: OutputCLI}
+		})), nil
 	}
 
-	graylogWriter, err := NewGELFWriter(GraylogEndpoint)
+	graylogWriter, err := NewGELFWriter(GraylogEndpoint, opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	asyncWriter := NewAsyncWriter(graylogWriter,
+		append([]AsyncOption{WithAsyncStats(graylogWriter.Stats())}, graylogWriter.async...)...)
+
 	log = log.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
 		return zapcore.NewTee(
-			c,
-			zapcore.NewSampler(
-				zapcore.NewCore(NewGELFEncoder(), graylogWriter, zap.NewAtomicLevelAt(zapcore.Level(GraylogLevel))),
-				time.Second,
-				100,
-				100,
-			),
+			levelCore{Core: withHost(c), levels: levels, output: OutputCLI},
+			levelCore{
+				Core: zapcore.NewSampler(
+					gelfCore{zapcore.NewCore(NewGELFEncoder(), asyncWriter, zapcore.DebugLevel)},
+					time.Second,
+					100,
+					100,
+				),
+				levels: levels,
+				output: OutputGraylog,
+			},
 		)
 	}))
 
-	// Add hostname if we can get it.
+	return log, nil
+}
+
+// withHost adds the hostname to the entries of the console core if we can get it. The GELF
+// encoder adds it to the messages sent to Graylog.
+func withHost(c zapcore.Core) zapcore.Core {
 	if host, err := os.Hostname(); err == nil {
-		log = log.With(zap.String("host", host))
+		return c.With([]zapcore.Field{zap.String("host", host)})
 	}
-
-	return log, nil
+	return c
 }
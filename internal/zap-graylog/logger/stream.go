@@ -0,0 +1,142 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// writeStream sends a message on the TCP or TLS connection, framed by a null byte. While the
+// connection is down, the message is buffered and sent once reconnected, so that Write
+// doesn't fail.
+func (w *GELFWriter) writeStream(buf []byte) (int, error) {
+	frame := make([]byte, 0, len(buf)+1)
+	frame = append(frame, bytes.TrimRight(buf, "\n")...)
+	frame = append(frame, 0)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// the buffered messages go first, to keep the order
+	if w.conn != nil && len(w.pending) == 0 {
+		if err := w.writeFrame(w.conn, frame); err == nil {
+			atomic.AddUint64(&w.stats.sent, 1)
+			return len(buf), nil
+		}
+		atomic.AddUint64(&w.stats.failed, 1)
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	w.enqueue(frame)
+	w.reconnect()
+	return len(buf), nil
+}
+
+func (w *GELFWriter) writeFrame(conn net.Conn, frame []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(w.dialTimeout)); err != nil {
+		return err
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// enqueue buffers a frame, applying the drop policy when the buffer is full.
+// The lock must be held.
+func (w *GELFWriter) enqueue(frame []byte) {
+	if len(w.pending) >= w.bufferSize {
+		atomic.AddUint64(&w.stats.dropped, 1)
+		if w.dropPolicy == DropNewest {
+			return
+		}
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+	}
+	w.pending = append(w.pending, frame)
+}
+
+// reconnect starts the reconnection loop, unless it is running or the writer is closed.
+// The lock must be held.
+func (w *GELFWriter) reconnect() {
+	if w.reconnecting {
+		return
+	}
+	select {
+	case <-w.closed:
+		return
+	default:
+	}
+	w.reconnecting = true
+	go w.reconnectLoop()
+}
+
+// reconnectLoop dials Graylog with an exponential backoff, and sends the buffered messages
+// before handing the connection over to Write.
+func (w *GELFWriter) reconnectLoop() {
+	delay := w.backoffMin
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-w.closed:
+			timer.Stop()
+			w.lock.Lock()
+			w.reconnecting = false
+			w.lock.Unlock()
+			return
+		case <-timer.C:
+		}
+
+		if delay *= 2; delay > w.backoffMax {
+			delay = w.backoffMax
+		}
+
+		conn, err := w.dial()
+		if err != nil {
+			continue
+		}
+		if w.drain(conn) {
+			return
+		}
+	}
+}
+
+// drain sends the buffered messages on conn, and keeps it as the connection of the writer
+// when they are all sent. It returns false when the connection failed again.
+func (w *GELFWriter) drain(conn net.Conn) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	select {
+	case <-w.closed:
+		conn.Close()
+		w.reconnecting = false
+		return true
+	default:
+	}
+
+	for len(w.pending) > 0 {
+		if err := w.writeFrame(conn, w.pending[0]); err != nil {
+			atomic.AddUint64(&w.stats.failed, 1)
+			conn.Close()
+			return false
+		}
+		atomic.AddUint64(&w.stats.sent, 1)
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+	}
+	w.pending = nil
+	w.conn = conn
+	w.reconnecting = false
+	return true
+}
+
+func (w *GELFWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: w.dialTimeout}
+	if w.transport == TransportTLS {
+		// a nil configuration verifies the certificate against the host of the address
+		return tls.DialWithDialer(dialer, "tcp", w.addr, w.tlsConfig)
+	}
+	return dialer.Dial("tcp", w.addr)
+}
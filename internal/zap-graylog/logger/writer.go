@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/rand"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // See http://docs.graylog.org/en/2.4/pages/gelf.html.
@@ -25,21 +29,191 @@ var (
 	chunkedMagicBytes = []byte{0x1e, 0x0f}
 )
 
+// Transports of the GELF messages.
+const (
+	// TransportUDP sends gzipped messages, chunked if larger than a datagram.
+	TransportUDP = "udp"
+	// TransportTCP sends null-byte framed messages on a TCP connection.
+	TransportTCP = "tcp"
+	// TransportTLS sends null-byte framed messages on a TLS connection.
+	TransportTLS = "tls"
+)
+
+// Drop policies of the buffer of the stream transports, when it is full.
+const (
+	// DropOldest evicts the oldest buffered message to keep the new one.
+	DropOldest = "drop_oldest"
+	// DropNewest rejects the new message.
+	DropNewest = "drop_newest"
+)
+
+// Stats counts the messages of a GELFWriter. It can be shared by several writers.
+type Stats struct {
+	sent    uint64
+	dropped uint64
+	failed  uint64
+}
+
+// Sent returns how many messages were sent.
+func (s *Stats) Sent() uint64 {
+	return atomic.LoadUint64(&s.sent)
+}
+
+// Dropped returns how many messages were dropped: too large for UDP, or evicted from the
+// buffer of the stream transports.
+func (s *Stats) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Failed returns how many sends failed. The messages of the stream transports are sent again
+// once reconnected.
+func (s *Stats) Failed() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
 // GELFWriter is a writter following the GELF specs.
-// It will write in udp using a gzip compression.
+// With UDP, it will write using a gzip compression. With TCP and TLS, the messages are
+// buffered while Graylog is unreachable, and sent once reconnected.
 type GELFWriter struct {
-	conn net.Conn
+	addr        string
+	transport   string
+	tlsConfig   *tls.Config
+	dialTimeout time.Duration
+	bufferSize  int
+	dropPolicy  string
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	stats       *Stats
+	async       []AsyncOption // options of the AsyncWriter wrapping the writer in NewLogger
+
+	lock         sync.Mutex // guard access to "conn", "pending" and "reconnecting"
+	conn         net.Conn
+	pending      [][]byte // framed messages waiting for the connection, oldest first
+	reconnecting bool
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// Option is the type of option passed to NewGELFWriter and NewLogger.
+type Option func(w *GELFWriter)
+
+// WithTransport sets the transport, TransportUDP, TransportTCP or TransportTLS.
+// Default: TransportUDP
+func WithTransport(transport string) Option {
+	return func(w *GELFWriter) {
+		w.transport = transport
+	}
+}
+
+// WithTLSConfig sets the configuration of the TLS transport.
+// Default: the system roots, with the server name of the address
+func WithTLSConfig(c *tls.Config) Option {
+	return func(w *GELFWriter) {
+		w.tlsConfig = c
+	}
+}
+
+// WithDialTimeout sets the timeout of the connections and writes of the stream transports.
+// Default: 5s
+func WithDialTimeout(d time.Duration) Option {
+	return func(w *GELFWriter) {
+		if d > 0 {
+			w.dialTimeout = d
+		}
+	}
+}
+
+// WithBuffer sets the number of messages buffered while Graylog is unreachable, and the
+// policy applied when the buffer is full, DropOldest or DropNewest.
+// Default: 1000, DropOldest
+func WithBuffer(size int, policy string) Option {
+	return func(w *GELFWriter) {
+		if size > 0 {
+			w.bufferSize = size
+		}
+		w.dropPolicy = policy
+	}
+}
+
+// WithBackoff sets the delay before the first reconnection, doubled after each failure up to max.
+// Default: 100ms, 30s
+func WithBackoff(min, max time.Duration) Option {
+	return func(w *GELFWriter) {
+		if min > 0 {
+			w.backoffMin = min
+		}
+		if max >= w.backoffMin {
+			w.backoffMax = max
+		}
+	}
+}
+
+// WithStats sets the counters of the messages.
+// Default: counters private to the writer
+func WithStats(s *Stats) Option {
+	return func(w *GELFWriter) {
+		if s != nil {
+			w.stats = s
+		}
+	}
+}
+
+// WithAsync sets the options of the AsyncWriter sending the messages of NewLogger in the
+// background. NewGELFWriter ignores them.
+// Default: the defaults of NewAsyncWriter
+func WithAsync(opts ...AsyncOption) Option {
+	return func(w *GELFWriter) {
+		w.async = append(w.async, opts...)
+	}
 }
 
 // NewGELFWriter will create a new GELFWriter.
-// We expect a valid udp address.
-func NewGELFWriter(addr string) (*GELFWriter, error) {
-	conn, err := net.Dial("udp", addr)
-	if err != nil {
-		return nil, err
+// We expect a valid address. With TCP and TLS, Graylog doesn't have to be reachable yet:
+// the writer connects in the background.
+func NewGELFWriter(addr string, opts ...Option) (*GELFWriter, error) {
+	w := &GELFWriter{
+		addr:        addr,
+		transport:   TransportUDP,
+		dialTimeout: 5 * time.Second,
+		bufferSize:  1000,
+		dropPolicy:  DropOldest,
+		backoffMin:  100 * time.Millisecond,
+		backoffMax:  30 * time.Second,
+		stats:       &Stats{},
+		closed:      make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(w)
 	}
 
-	return &GELFWriter{conn: conn}, nil
+	switch w.transport {
+	case TransportUDP:
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = conn
+	case TransportTCP, TransportTLS:
+		if w.dropPolicy != DropOldest && w.dropPolicy != DropNewest {
+			return nil, fmt.Errorf("unknown drop policy %q", w.dropPolicy)
+		}
+		if conn, err := w.dial(); err == nil {
+			w.conn = conn
+		} else {
+			w.lock.Lock()
+			w.reconnect()
+			w.lock.Unlock()
+		}
+	default:
+		return nil, fmt.Errorf("unknown GELF transport %q", w.transport)
+	}
+
+	return w, nil
+}
+
+// Stats returns the counters of the messages.
+func (w *GELFWriter) Stats() *Stats {
+	return w.stats
 }
 
 // Sync implements WriteSyncer.
@@ -47,8 +221,37 @@ func (w *GELFWriter) Sync() error {
 	return nil
 }
 
+// Close stops the reconnections and closes the connection. The buffered messages are lost.
+func (w *GELFWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+	})
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
 // Write implements io.Writer.
 func (w *GELFWriter) Write(buf []byte) (int, error) {
+	if w.transport != TransportUDP {
+		return w.writeStream(buf)
+	}
+
+	n, err := w.writeUDP(buf)
+	if err != nil {
+		atomic.AddUint64(&w.stats.failed, 1)
+		return n, err
+	}
+	atomic.AddUint64(&w.stats.sent, 1)
+	return n, nil
+}
+
+func (w *GELFWriter) writeUDP(buf []byte) (int, error) {
 	b, err := w.compress(buf)
 	if err != nil {
 		return 0, err
@@ -98,6 +301,7 @@ func (w *GELFWriter) chunkCount(b []byte) int {
 // writeChunked send message by chunks.
 func (w *GELFWriter) writeChunked(count int, b []byte) (n int, err error) {
 	if count > maxChunkCount {
+		atomic.AddUint64(&w.stats.dropped, 1)
 		return 0, fmt.Errorf("need %d chunks but shold be later or equal to %d", count, maxChunkCount)
 	}
 
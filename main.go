@@ -29,15 +29,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/ariden83/fizz-buzz/config"
 	"github.com/ariden83/fizz-buzz/internal/metrics"
 	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.opentelemetry.io/otel"
 	"os/signal"
 	"time"
 	// _ "github.com/go-swagger/go-swagger/cmd/swagger"
 	// _ "gopkg.in/alecthomas/gometalinter.v1"
 	"go.uber.org/zap"
+	"io/ioutil"
 	l "log"
 	"os"
 )
@@ -46,10 +50,15 @@ var Version = "0.0.0"
 
 func main() {
 	conf := config.New()
-	log, err := logger.NewLogger(
-		fmt.Sprintf("%s:%d", conf.Logger.Host, conf.Logger.Port),
+	logStats := &logger.Stats{}
+	logOpts, err := loggerOptions(conf, logStats)
+	if err != nil {
+		l.Fatal("cannot setup logger: ", err)
+	}
+	levels := logger.NewLevels(
 		logger.Level(logger.LevelsMap[conf.Logger.Level]),
 		logger.Level(logger.LevelsMap[conf.Logger.CLILevel]))
+	log, err := logger.New(fmt.Sprintf("%s:%d", conf.Logger.Host, conf.Logger.Port), levels, logOpts...)
 	if err != nil {
 		l.Fatal("cannot setup logger")
 	}
@@ -59,22 +68,26 @@ func main() {
 		hostname = "N/A"
 	}
 	log = log.With(zap.String("facility", conf.Name), zap.String("version", Version), zap.String("instance", hostname))
-	defer log.Sync()
-
 	log.Info(conf.String())
 
-	m := metrics.New(conf, log)
+	// the tracing reports its failures, such as the spans it fails to export, to the global handler
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn("tracing error", zap.String("endpoint", conf.Tracing.Endpoint), zap.Error(err))
+	}))
+
+	m := metrics.New(conf, log, metrics.WithVersion(Version), metrics.WithLogStats(logStats))
 
 	server := &Server{
 		log:     log,
 		conf:    conf,
 		metrics: m,
+		levels:  levels,
 	}
 
 	stop := make(chan error, 1)
+	server.startHTTPServer(stop)
 	server.startMetricsServer(stop)
 	server.startSwaggerServer(stop)
-	server.startHTTPServer(stop)
 
 	/**
 	 * And wait for shutdown via signal or error.
@@ -93,4 +106,42 @@ func main() {
 	defer cancel()
 	server.Shutdown(stopCtx)
 	log.Debug("Services shutted down")
+
+	// sends the logs still buffered, at most the sync timeout
+	log.Sync()
+}
+
+// loggerOptions returns the options of the writer to graylog set in conf.
+func loggerOptions(conf *config.Config, stats *logger.Stats) ([]logger.Option, error) {
+	opts := []logger.Option{
+		logger.WithTransport(conf.Logger.Transport),
+		logger.WithBuffer(conf.Logger.BufferSize, conf.Logger.DropPolicy),
+		logger.WithBackoff(
+			time.Duration(conf.Logger.BackoffMin)*time.Millisecond,
+			time.Duration(conf.Logger.BackoffMax)*time.Millisecond),
+		logger.WithStats(stats),
+		logger.WithAsync(
+			logger.WithRingSize(conf.Logger.AsyncRingSize),
+			logger.WithBatch(conf.Logger.AsyncBatchSize, time.Duration(conf.Logger.AsyncFlushInterval)*time.Millisecond),
+			logger.WithSyncTimeout(time.Duration(conf.Logger.SyncTimeout)*time.Millisecond)),
+	}
+	if conf.Logger.Transport != logger.TransportTLS {
+		return opts, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         conf.Logger.Host,
+		InsecureSkipVerify: conf.Logger.TLSInsecureSkipVerify,
+	}
+	if conf.Logger.TLSCAPath != "" {
+		pem, err := ioutil.ReadFile(conf.Logger.TLSCAPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.Logger.TLSCAPath)
+		}
+	}
+	return append(opts, logger.WithTLSConfig(tlsConfig)), nil
 }
@@ -26,9 +26,10 @@ type BenchServer struct {
 }
 
 func setUpBench() *benches.Tests {
-	conf := config.New()
+	conf := newTestConfig()
 	conf.Logger.Level = "ERROR"
 	conf.CLILevel = "ERROR"
+	conf.RateLimit.Active = false
 	l, err := logger.NewLogger(
 		fmt.Sprintf("%s:%d", conf.Host, conf.Logger.Port),
 		logger.Level(logger.LevelsMap[conf.Logger.Level]),
@@ -40,13 +41,17 @@ func setUpBench() *benches.Tests {
 	l = l.With(zap.String("facility", conf.Name), zap.String("version", Version))
 	defer l.Sync()
 
-	m := metrics.New(conf, l)
+	m := metrics.New(conf, l, metrics.WithVersion(Version))
 
-	httpHpt := httpEndpoint.New(httpEndpoint.EndPointInput{
+	httpHpt, err := httpEndpoint.New(httpEndpoint.EndPointInput{
 		Config:  conf,
 		Log:     l,
 		Metrics: m,
+		Version: Version,
 	}, httpEndpoint.WithXCache())
+	if err != nil {
+		l.Fatal("cannot setup endpoint", zap.Error(err))
+	}
 	tts := &benches.Tests{
 		Conf:          conf,
 		HTTPEndRouter: httpHpt.LoadHttpTreeMux(),
@@ -1,37 +1,94 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/ariden83/fizz-buzz/config"
+	httpEndpoint "github.com/ariden83/fizz-buzz/internal/endpoint"
 	"github.com/ariden83/fizz-buzz/internal/metrics"
 	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
 	"github.com/ariden83/fizz-buzz/tests"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 // TestApi
 func TestApi(t *testing.T) {
-	c := setUpTest()
+	c, collector, statsd := setUpTest()
 	tts := &tests.Tests{
 		Conf:       c,
 		DefaultURL: fmt.Sprintf("http://%s:%d", c.Host, c.Port),
+		Collector:  collector,
+		StatsD:     statsd,
 	}
 	time.Sleep(500 * time.Millisecond)
 	tts.StartFunctionnalTests(t)
 	t.Run("HealthCheck", tts.HealthCheckTest)
 	t.Run("Metrics", tts.MetricsTest)
 	t.Run("Test GET /fizz-buzz", tts.GetFizzBuzzTest)
+	t.Run("Test CORS", tts.CORSTest)
+	t.Run("Test tracing", tts.TracingTest)
+	t.Run("Test metrics labels", tts.MetricsLabelsTest)
+	t.Run("Test StatsD", tts.StatsDTest)
+	t.Run("Test GELF", tts.GELFTest)
+	t.Run("Test log levels", tts.LogLevelTest)
 }
 
-func setUpTest() *config.Config {
-	conf := config.New()
+var (
+	confOnce sync.Once
+	baseConf *config.Config
+)
+
+// newTestConfig returns a copy of the configuration, which can only be loaded once since it
+// registers command line flags.
+func newTestConfig() *config.Config {
+	confOnce.Do(func() {
+		baseConf = config.New()
+	})
+	conf := *baseConf
+	return &conf
+}
+
+func setUpTest() (*config.Config, *tests.Collector, *tests.StatsDListener) {
+	conf := newTestConfig()
+	conf.Auth.KeysPath = "tests/testdata/api_keys.yaml"
+	conf.JWT.JWKSPath = "tests/testdata/jwks.json"
+	conf.RateLimit.Active = true
+	conf.Admission.Active = true
+	conf.Usage.Active = true
+
+	collector := tests.NewCollector()
+	conf.Tracing.Active = true
+	conf.Tracing.Endpoint = collector.URL()
+	conf.Tracing.FlushInterval = 100
 
-	l, err := logger.NewLogger(
-		fmt.Sprintf("%s:%d", conf.Host, conf.Logger.Port),
+	statsd, err := tests.NewStatsDListener()
+	if err != nil {
+		panic(err)
+	}
+	conf.Metrics.StatsDActive = true
+	conf.Metrics.StatsDAddr = statsd.Addr()
+	conf.Metrics.StatsDMaxPacketSize = 512
+	conf.Metrics.StatsDFlushInterval = 100
+
+	startTestServer(conf)
+	return conf, collector, statsd
+}
+
+// startTestServer starts the API and metrics servers of conf, each call with its own metrics.
+func startTestServer(conf *config.Config) *Server {
+	levels := logger.NewLevels(
 		logger.Level(logger.LevelsMap[conf.Logger.Level]),
 		logger.Level(logger.LevelsMap[conf.CLILevel]))
+	l, err := logger.New(fmt.Sprintf("%s:%d", conf.Host, conf.Logger.Port), levels)
 	if err != nil {
 		l.Fatal("cannot setup logger")
 	}
@@ -40,18 +97,243 @@ func setUpTest() *config.Config {
 
 	l.Info(fmt.Sprintf("%#v", conf))
 
-	m := metrics.New(conf, l)
+	m := metrics.New(conf, l, metrics.WithVersion(Version))
 
 	server := &Server{
 		log:     l,
 		conf:    conf,
 		metrics: m,
+		levels:  levels,
 	}
 
 	stop := make(chan error, 1)
-	go server.startMetricsServer(stop)
+	server.startHTTPServer(stop)
+	server.startMetricsServer(stop)
 	//	go server.startSwaggerRoutes(stop)
-	go server.startHTTPServer(stop)
 
-	return conf
+	return server
+}
+
+// TestServers checks that several servers run in one process, each with its own metrics.
+func TestServers(t *testing.T) {
+	var (
+		confs   []*config.Config
+		servers []*Server
+	)
+	for i := 0; i < 2; i++ {
+		conf := newTestConfig()
+		conf.Port = freePort(t)
+		conf.Metrics.Port = freePort(t)
+		servers = append(servers, startTestServer(conf))
+		confs = append(confs, conf)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// only the first server is requested
+	response, err := http.Get(fmt.Sprintf("http://%s:%d/fizz-buzz?limit=5", confs[0].Host, confs[0].Port))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("wrong http status returned ", response.StatusCode)
+	}
+
+	series := `fizzbuzz_api_http_requests_total{app="fizz-buzz",cache="MISS",method="GET",route="/fizz-buzz",status="2xx"} 1`
+	for i, conf := range confs {
+		response, err := http.Get(fmt.Sprintf("http://%s:%d/metrics", conf.Host, conf.Metrics.Port))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		metrics := string(body)
+
+		if counted := strings.Contains(metrics, series); counted != (i == 0) {
+			t.Fatal("server ", i, " counted the requests of another server")
+		}
+		for _, name := range []string{"go_goroutines", "process_cpu_seconds_total", "go_build_info", "fizzbuzz_api_build_info"} {
+			if !strings.Contains(metrics, name) {
+				t.Fatal("metric ", name, " not served by server ", i)
+			}
+		}
+	}
+
+	// CORS allows any origin by default, as the service always did
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%d/fizz-buzz?limit=5", confs[0].Host, confs[0].Port), nil)
+	req.Header.Set("Origin", "https://example.com")
+	response, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	response.Body.Close()
+	if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Fatal("have Access-Control-Allow-Origin ", origin, ", we want *")
+	}
+
+	// the admin routes are closed without JWT verifier
+	for _, route := range []string{"/admin/cache/purge", "/admin/cache/invalidate?tag=word:fizz", "/admin/log-level", "/debug/pprof/"} {
+		response, err := http.Post(fmt.Sprintf("http://%s:%d%s", confs[0].Host, confs[0].Metrics.Port, route), "", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Fatal("have status ", response.StatusCode, " for ", route, ", we want ", http.StatusForbidden)
+		}
+	}
+
+	// a second shutdown of the endpoints must not panic
+	for _, server := range servers {
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			server.httpServer.Shutdown(ctx)
+			cancel()
+		}
+	}
+}
+
+// TestPeers checks that the peers server only serves the replicas sharing the secret, and only
+// the keys that the API builds.
+func TestPeers(t *testing.T) {
+	conf := newTestConfig()
+	conf.Port = freePort(t)
+	conf.Metrics.Port = freePort(t)
+	conf.Peers.Self = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	conf.Peers.Secret = "secret"
+	startTestServer(conf)
+	time.Sleep(500 * time.Millisecond)
+
+	for _, tt := range []struct {
+		key    string
+		secret string
+		want   int
+	}{
+		{key: "limit=5", secret: "secret", want: http.StatusOK},
+		{key: "limit=5&encoding=gzip&format=text", secret: "secret", want: http.StatusOK},
+		{key: "limit=5", want: http.StatusForbidden},
+		{key: "limit=5", secret: "wrong", want: http.StatusForbidden},
+		{key: "limit=5&nbOne=3&strOne=fizz&nbTwo=5&strTwo=buzz&nbOne=3", secret: "secret", want: http.StatusBadRequest},
+		{key: "limit=05", secret: "secret", want: http.StatusBadRequest},
+		{key: "limit=5&encoding=br&format=text", secret: "secret", want: http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+conf.Peers.Self+"/_xcache/?key="+url.QueryEscape(tt.key), nil)
+		if tt.secret != "" {
+			req.Header.Set("X-Xcache-Secret", tt.secret)
+		}
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != tt.want {
+			t.Fatal("have status ", response.StatusCode, " for key ", tt.key, " with secret ", tt.secret, ", we want ", tt.want)
+		}
+	}
+}
+
+// TestEndpointSetup checks that the endpoint fails to start with an API keys file missing, or
+// an invalid usage store.
+func TestEndpointSetup(t *testing.T) {
+	conf := newTestConfig()
+	conf.Auth.KeysPath = "tests/testdata/missing.yaml"
+	_, err := httpEndpoint.New(httpEndpoint.EndPointInput{
+		Config:  conf,
+		Log:     zap.NewNop(),
+		Metrics: metrics.New(conf, zap.NewNop()),
+		Version: Version,
+	}, httpEndpoint.WithAuth())
+	if err == nil {
+		t.Fatal("the endpoint started without its API keys")
+	}
+
+	conf = newTestConfig()
+	conf.Usage.Active = true
+	conf.Usage.StorePath = "tests/testdata/jwks.json"
+	_, err = httpEndpoint.New(httpEndpoint.EndPointInput{
+		Config:  conf,
+		Log:     zap.NewNop(),
+		Metrics: metrics.New(conf, zap.NewNop()),
+		Version: Version,
+	}, httpEndpoint.WithUsage())
+	if err == nil {
+		t.Fatal("the endpoint started with an invalid usage store")
+	}
+}
+
+// TestEndpointShutdown checks that an endpoint shut down before listening doesn't start.
+func TestEndpointShutdown(t *testing.T) {
+	conf := newTestConfig()
+	e, err := httpEndpoint.New(httpEndpoint.EndPointInput{
+		Config:  conf,
+		Log:     zap.NewNop(),
+		Metrics: metrics.New(conf, zap.NewNop()),
+		Version: Version,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	e.Shutdown(ctx)
+	if err := e.Listen(fmt.Sprintf("127.0.0.1:%d", freePort(t))); err != http.ErrServerClosed {
+		t.Fatal("have error ", err, ", we want ", http.ErrServerClosed)
+	}
+}
+
+// TestServerSetup checks that the server fails to start with a JWKS file missing.
+func TestServerSetup(t *testing.T) {
+	conf := newTestConfig()
+	conf.JWT.JWKSPath = "tests/testdata/missing.json"
+	server := &Server{
+		log:     zap.NewNop(),
+		conf:    conf,
+		metrics: metrics.New(conf, zap.NewNop()),
+	}
+
+	stop := make(chan error, 1)
+	server.startHTTPServer(stop)
+	select {
+	case err := <-stop:
+		if !strings.Contains(err.Error(), "fail to load JWKS") {
+			t.Fatal("have error ", err.Error(), ", we want the JWKS one")
+		}
+	default:
+		t.Fatal("the server started without its JWKS")
+	}
+	if server.httpServer != nil {
+		t.Fatal("the endpoint was set up without its JWKS")
+	}
+}
+
+// TestDefaultRegistry checks that the metrics can be registered on the default registry, which
+// has the collectors of the process already.
+func TestDefaultRegistry(t *testing.T) {
+	conf := newTestConfig()
+	m := metrics.New(conf, zap.NewNop(), metrics.WithRegistry(prometheus.DefaultRegisterer, prometheus.DefaultGatherer))
+
+	families, err := m.Gatherer.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	names := map[string]bool{}
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	for _, name := range []string{"go_goroutines", "process_cpu_seconds_total", "go_build_info", "fizzbuzz_api_build_info"} {
+		if !names[name] {
+			t.Fatal("metric ", name, " not gathered")
+		}
+	}
+}
+
+// freePort returns a TCP port free on the loopback interface.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
 }
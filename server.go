@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
+	"sync"
 
 	"context"
 	"github.com/ariden83/fizz-buzz/config"
+	"github.com/ariden83/fizz-buzz/internal/auth"
 	httpEndpoint "github.com/ariden83/fizz-buzz/internal/endpoint"
 	"github.com/ariden83/fizz-buzz/internal/metrics"
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
 	"github.com/juju/errors"
-	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/negroni"
 	"go.uber.org/zap"
 	"io/ioutil"
@@ -31,18 +34,80 @@ type Server struct {
 	log           *zap.Logger
 	conf          *config.Config
 	metrics       *metrics.Metrics
+	levels        *logger.Levels // levels of log, changed by the admin route if set
 	httpServer    *httpEndpoint.Endpoint
 	swaggerServer *http.Server
 	metricsServer *http.Server
+
+	jwtOnce sync.Once
+	jwt     *auth.Verifier
+	jwtErr  error
+}
+
+// verifier returns the JWT verifier shared by the servers, nil if JWT.JWKSPath isn't set.
+// It returns an error if the JWKS fails to load.
+func (s *Server) verifier() (*auth.Verifier, error) {
+	s.jwtOnce.Do(func() {
+		if s.conf.JWT.JWKSPath == "" {
+			return
+		}
+		v, err := auth.NewVerifier(s.conf.JWT.JWKSPath,
+			auth.WithIssuer(s.conf.JWT.Issuer),
+			auth.WithAudience(s.conf.JWT.Audience),
+			auth.WithClockSkew(time.Duration(s.conf.JWT.ClockSkew)*time.Second),
+			auth.WithReload(time.Duration(s.conf.JWT.ReloadInterval)*time.Second))
+		if err != nil {
+			s.jwtErr = errors.Annotatef(err, "fail to load JWKS of %s", s.conf.JWT.JWKSPath)
+			return
+		}
+		s.jwt = v
+		s.log.Info("JWKS loaded", zap.String("path", s.conf.JWT.JWKSPath))
+	})
+	return s.jwt, s.jwtErr
 }
 
+// require guards h with the scope. Without JWT verifier, h is never served.
+func (s *Server) require(scope string, h http.Handler) http.Handler {
+	if v, _ := s.verifier(); v != nil {
+		return v.Require(scope, h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden without jwt_jwks_path", http.StatusForbidden)
+	})
+}
+
+// startHTTPServer sets up the API endpoint, then serves it in the background. It must be
+// called before the other servers, which use the endpoint.
 func (s *Server) startHTTPServer(stop chan error) {
+	opts := []httpEndpoint.Option{httpEndpoint.WithAuth(), httpEndpoint.WithXCache(), httpEndpoint.WithWarmer(), httpEndpoint.WithUsage(), httpEndpoint.WithTracing()}
+	v, err := s.verifier()
+	if err != nil {
+		stop <- errors.Annotate(err, "cannot setup server HTTP")
+		return
+	}
+	if v != nil {
+		opts = append(opts, httpEndpoint.WithJWT(v))
+	}
+	httpServer, err := httpEndpoint.New(httpEndpoint.EndPointInput{
+		Config:  s.conf,
+		Log:     s.log,
+		Metrics: s.metrics,
+		Version: Version,
+	}, opts...)
+	if err != nil {
+		stop <- errors.Annotate(err, "cannot setup server HTTP")
+		return
+	}
+	s.httpServer = httpServer
+
 	go func() {
-		s.httpServer = httpEndpoint.New(httpEndpoint.EndPointInput{
-			Config:  s.conf,
-			Log:     s.log,
-			Metrics: s.metrics,
-		}, httpEndpoint.WithXCache())
+		if s.conf.Peers.Self != "" {
+			go func() {
+				if err := s.httpServer.ListenPeers(); err != nil {
+					stop <- errors.Annotate(err, "cannot start peers server HTTP")
+				}
+			}()
+		}
 		if err := s.httpServer.Listen(fmt.Sprintf("%s:%d", s.conf.Host, s.conf.Port)); err != nil {
 			stop <- errors.Annotate(err, "cannot start server HTTP")
 		}
@@ -112,9 +177,17 @@ func (s *Server) startSwaggerServer(stop chan error) {
 }
 
 func (s *Server) Shutdown(ctx context.Context) {
-	s.httpServer.Shutdown(ctx)
+	if s.httpServer != nil {
+		s.httpServer.Shutdown(ctx)
+	}
 	s.metricsServer.Shutdown(ctx)
 	s.swaggerServer.Shutdown(ctx)
+	if s.jwt != nil {
+		s.jwt.Close()
+	}
+	if err := s.metrics.Close(); err != nil {
+		s.log.Error("fail to flush metrics", zap.Error(err))
+	}
 }
 
 func (s *Server) startMetricsServer(stop chan error) {
@@ -147,7 +220,8 @@ func (s *Server) startMetricsServer(stop chan error) {
 		}
 	})
 
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", s.metrics.Handler())
+	s.Admin(mux)
 	s.PProf(mux)
 
 	addr := fmt.Sprintf("%s:%d", s.conf.Metrics.Host, s.conf.Metrics.Port)
@@ -167,16 +241,55 @@ func (s *Server) startMetricsServer(stop chan error) {
 	}()
 }
 
+// Admin registers the routes managing the cache and the levels of log, guarded by JWT.AdminScope.
+func (s *Server) Admin(mux *http.ServeMux) {
+	if s.levels != nil {
+		mux.Handle("/admin/log-level", s.require(s.conf.JWT.AdminScope, s.levels))
+	}
+	mux.Handle("/admin/cache/invalidate", s.require(s.conf.JWT.AdminScope, s.adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		tag := r.URL.Query().Get("tag")
+		if tag == "" {
+			http.Error(w, "missing tag", http.StatusBadRequest)
+			return
+		}
+		n := s.httpServer.InvalidateCache(tag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"invalidated":` + strconv.Itoa(n) + `}`))
+	})))
+	mux.Handle("/admin/cache/purge", s.require(s.conf.JWT.AdminScope, s.adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		s.httpServer.PurgeCache()
+		w.WriteHeader(http.StatusNoContent)
+	})))
+}
+
+// adminHandler only serves POST requests, once the HTTP server is started.
+func (s *Server) adminHandler(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.httpServer == nil {
+			http.Error(w, "server not started", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// PProf registers the pprof handlers, guarded by JWT.PProfScope.
 func (s *Server) PProf(mux *http.ServeMux) {
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
-	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
-	mux.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
-	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
-	mux.Handle("/debug/pprof/trace", pprof.Handler("trace"))
+	scope := s.conf.JWT.PProfScope
+	mux.Handle("/debug/pprof/", s.require(scope, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", s.require(scope, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", s.require(scope, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", s.require(scope, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/allocs", s.require(scope, pprof.Handler("allocs")))
+	mux.Handle("/debug/pprof/heap", s.require(scope, pprof.Handler("heap")))
+	mux.Handle("/debug/pprof/mutex", s.require(scope, pprof.Handler("mutex")))
+	mux.Handle("/debug/pprof/goroutine", s.require(scope, pprof.Handler("goroutine")))
+	mux.Handle("/debug/pprof/block", s.require(scope, pprof.Handler("block")))
+	mux.Handle("/debug/pprof/threadcreate", s.require(scope, pprof.Handler("threadcreate")))
+	mux.Handle("/debug/pprof/trace", s.require(scope, pprof.Handler("trace")))
 }
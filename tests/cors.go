@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const originForTests string = "https://app.example.com"
+
+type methodScenario struct {
+	description    string
+	method         string
+	route          string
+	statusCode     int
+	headers        map[string]string
+	expectedHeader testHeader
+}
+
+var corsTests = []methodScenario{
+	{
+		`Should answer a CORS preflight request`,
+		http.MethodOptions,
+		validPath,
+		http.StatusNoContent,
+		map[string]string{
+			"Origin":                         originForTests,
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "X-API-Key, X-Request-ID",
+		},
+		func(t *testing.T, header http.Header) {
+			if origin := header.Get("Access-Control-Allow-Origin"); origin != "*" {
+				t.Fatal("Bad Access-Control-Allow-Origin header, have '", origin, "' and we want '*'")
+			}
+			if methods := header.Get("Access-Control-Allow-Methods"); methods != "GET, HEAD, OPTIONS" {
+				t.Fatal("Bad Access-Control-Allow-Methods header, have '", methods, "'")
+			}
+			if maxAge := header.Get("Access-Control-Max-Age"); maxAge != "600" {
+				t.Fatal("Bad Access-Control-Max-Age header, have '", maxAge, "' and we want '600'")
+			}
+		},
+	},
+	{
+		`Should reject a CORS preflight request for a method not allowed`,
+		http.MethodOptions,
+		validPath,
+		http.StatusForbidden,
+		map[string]string{
+			"Origin":                        originForTests,
+			"Access-Control-Request-Method": "DELETE",
+		},
+		func(t *testing.T, header http.Header) {
+			if origin := header.Get("Access-Control-Allow-Origin"); origin != "" {
+				t.Fatal("Unexpected Access-Control-Allow-Origin header '", origin, "'")
+			}
+		},
+	},
+	{
+		`Should answer an OPTIONS request without CORS`,
+		http.MethodOptions,
+		validPath,
+		http.StatusNoContent,
+		nil,
+		func(t *testing.T, header http.Header) {
+			if allow := header.Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+				t.Fatal("Bad Allow header, have '", allow, "'")
+			}
+		},
+	},
+	{
+		`Should expose the headers of a cross-origin request`,
+		http.MethodGet,
+		validPath + "?limit=10",
+		http.StatusOK,
+		map[string]string{
+			"Origin": originForTests,
+		},
+		func(t *testing.T, header http.Header) {
+			if origin := header.Get("Access-Control-Allow-Origin"); origin != "*" {
+				t.Fatal("Bad Access-Control-Allow-Origin header, have '", origin, "' and we want '*'")
+			}
+			if header.Get("Access-Control-Expose-Headers") == "" {
+				t.Fatal("Fail to get Header Access-Control-Expose-Headers")
+			}
+		},
+	},
+	{
+		`Should serve HEAD requests with the headers of GET and the security headers`,
+		http.MethodHead,
+		validPath + "?limit=10",
+		http.StatusOK,
+		nil,
+		func(t *testing.T, header http.Header) {
+			if header.Get("ETag") == "" {
+				t.Fatal("Fail to get Header ETag")
+			}
+			if nosniff := header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+				t.Fatal("Bad X-Content-Type-Options header, have '", nosniff, "' and we want 'nosniff'")
+			}
+			if header.Get("Strict-Transport-Security") == "" {
+				t.Fatal("Fail to get Header Strict-Transport-Security")
+			}
+			if _, err := time.Parse(http.TimeFormat, header.Get("Date")); err != nil {
+				t.Fatal("Bad Date header, have '", header.Get("Date"), "': ", err)
+			}
+		},
+	},
+}
+
+func (tts *Tests) CORSTest(t *testing.T) {
+	for _, test := range corsTests {
+		t.Run(test.description, func(t *testing.T) {
+			r, err := http.NewRequest(test.method, tts.DefaultURL+test.route, nil)
+			if err != nil {
+				t.Fatal("fail to build request ", err.Error())
+			}
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+
+			response, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != test.statusCode {
+				t.Fatal("wrong http status returned ", response.StatusCode, ", we want ", test.statusCode)
+			}
+			if test.expectedHeader != nil {
+				test.expectedHeader(t, response.Header)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.uber.org/zap"
+)
+
+// GELFListener is a local TCP listener standing in for a Graylog GELF input.
+type GELFListener struct {
+	listener net.Listener
+	lock     sync.Mutex
+	messages []string
+}
+
+// NewGELFListener starts a listener on addr, "127.0.0.1:0" for any port.
+func NewGELFListener(addr string) (*GELFListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &GELFListener{listener: listener}
+	go l.accept()
+	return l, nil
+}
+
+// Addr returns the address of the listener.
+func (l *GELFListener) Addr() string {
+	return l.listener.Addr().String()
+}
+
+// Close stops the listener.
+func (l *GELFListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *GELFListener) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.receive(conn)
+	}
+}
+
+func (l *GELFListener) receive(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := r.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		l.lock.Lock()
+		l.messages = append(l.messages, string(frame[:len(frame)-1]))
+		l.lock.Unlock()
+	}
+}
+
+// wait returns the messages received, waiting until there are at least n of them.
+func (l *GELFListener) wait(n int, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		l.lock.Lock()
+		messages := append([]string{}, l.messages...)
+		l.lock.Unlock()
+		if len(messages) >= n || time.Now().After(deadline) {
+			return messages
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slowWriter stands in for a slow network, blocking each write.
+type slowWriter struct {
+	delay time.Duration
+	lock  sync.Mutex
+	msgs  []string
+}
+
+func (w *slowWriter) Write(buf []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.msgs = append(w.msgs, string(buf))
+	return len(buf), nil
+}
+
+func (w *slowWriter) messages() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string{}, w.msgs...)
+}
+
+// unusedAddr returns an address nobody listens on, until the test listens on it.
+func unusedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func (tts *Tests) GELFTest(t *testing.T) {
+	t.Run("Should send null-byte framed GELF 1.1 messages over TCP", func(t *testing.T) {
+		l, err := NewGELFListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer l.Close()
+
+		stats := &logger.Stats{}
+		log, err := logger.NewLogger(l.Addr(), logger.Level(zap.InfoLevel), logger.Level(zap.FatalLevel),
+			logger.WithTransport(logger.TransportTCP), logger.WithStats(stats))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		log.With(zap.String("version", "1.2.3")).Info("over tcp", zap.String("host", "api"))
+		log.Sync()
+
+		messages := l.wait(1, 2*time.Second)
+		if len(messages) != 1 {
+			t.Fatal("have ", len(messages), " messages, we want 1")
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(messages[0]), &m); err != nil {
+			t.Fatal("message '", messages[0], "' is not JSON: ", err.Error())
+		}
+		for key, want := range map[string]interface{}{
+			"version":       "1.1",
+			"short_message": "over tcp",
+			"_version":      "1.2.3",
+			"_host":         "api",
+		} {
+			if m[key] != want {
+				t.Fatal("field ", key, " is ", m[key], ", we want ", want)
+			}
+		}
+		if host, _ := m["host"].(string); host == "" {
+			t.Fatal("field host is missing")
+		}
+		if stats.Sent() != 1 {
+			t.Fatal("have ", stats.Sent(), " messages sent, we want 1")
+		}
+	})
+
+	t.Run("Should buffer the messages and send them once reconnected", func(t *testing.T) {
+		addr := unusedAddr(t)
+		w, err := logger.NewGELFWriter(addr, logger.WithTransport(logger.TransportTCP),
+			logger.WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer w.Close()
+
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write([]byte(fmt.Sprintf("{\"short_message\":\"%d\"}\n", i))); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if w.Stats().Sent() != 0 {
+			t.Fatal("messages sent while Graylog is unreachable")
+		}
+
+		l, err := NewGELFListener(addr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer l.Close()
+
+		messages := l.wait(3, 2*time.Second)
+		for i, m := range messages {
+			if want := fmt.Sprintf("{\"short_message\":\"%d\"}", i); m != want {
+				t.Fatal("have message '", m, "', we want '", want, "'")
+			}
+		}
+		if len(messages) != 3 || w.Stats().Sent() != 3 {
+			t.Fatal("have ", len(messages), " messages received and ", w.Stats().Sent(), " sent, we want 3")
+		}
+	})
+
+	t.Run("Should drop the oldest messages when the buffer is full", func(t *testing.T) {
+		addr := unusedAddr(t)
+		w, err := logger.NewGELFWriter(addr, logger.WithTransport(logger.TransportTCP),
+			logger.WithBuffer(2, logger.DropOldest), logger.WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer w.Close()
+
+		for i := 0; i < 5; i++ {
+			w.Write([]byte(fmt.Sprintf("{\"short_message\":\"%d\"}\n", i)))
+		}
+		if w.Stats().Dropped() != 3 {
+			t.Fatal("have ", w.Stats().Dropped(), " messages dropped, we want 3")
+		}
+
+		l, err := NewGELFListener(addr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer l.Close()
+
+		messages := l.wait(2, 2*time.Second)
+		if len(messages) != 2 || messages[0] != `{"short_message":"3"}` || messages[1] != `{"short_message":"4"}` {
+			t.Fatal("have messages ", messages, ", we want the last 2")
+		}
+	})
+
+	t.Run("Should not wait for the transport, and send the messages on Sync", func(t *testing.T) {
+		slow := &slowWriter{delay: 5 * time.Millisecond}
+		w := logger.NewAsyncWriter(slow, logger.WithBatch(10, time.Hour))
+		defer w.Close()
+
+		start := time.Now()
+		for i := 0; i < 50; i++ {
+			w.Write([]byte(fmt.Sprintf("%d", i)))
+		}
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+			t.Fatal("writes took ", elapsed, ", they wait for the transport")
+		}
+
+		if err := w.Sync(); err != nil {
+			t.Fatal(err.Error())
+		}
+		messages := slow.messages()
+		if len(messages) != 50 || messages[0] != "0" || messages[49] != "49" {
+			t.Fatal("have ", len(messages), " messages sent, we want the 50 in order")
+		}
+	})
+
+	t.Run("Should give up syncing after the timeout and drop the oldest messages", func(t *testing.T) {
+		slow := &slowWriter{delay: 100 * time.Millisecond}
+		stats := &logger.Stats{}
+		w := logger.NewAsyncWriter(slow, logger.WithRingSize(4), logger.WithBatch(1, time.Hour),
+			logger.WithSyncTimeout(20*time.Millisecond), logger.WithAsyncStats(stats))
+		defer w.Close()
+
+		for i := 0; i < 10; i++ {
+			w.Write([]byte(fmt.Sprintf("%d", i)))
+		}
+		if err := w.Sync(); err != logger.ErrSyncTimeout {
+			t.Fatal("have error ", err, ", we want ", logger.ErrSyncTimeout)
+		}
+		// the sender holds at most a message, the ring the last 4
+		if dropped := stats.Dropped(); dropped < 5 || dropped > 6 {
+			t.Fatal("have ", dropped, " messages dropped, we want 5 or 6")
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ariden83/fizz-buzz/internal/zap-graylog/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logLevel sends a request to the admin route of the levels, and decodes the levels returned.
+func (tts *Tests) logLevel(t *testing.T, method, body string) (int, map[string]logger.OutputState) {
+	url := fmt.Sprintf("http://%s:%d/admin/log-level", tts.Conf.Host, tts.Conf.Metrics.Port)
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer "+jwtAdminForTests)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer response.Body.Close()
+
+	var state map[string]logger.OutputState
+	if response.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&state); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return response.StatusCode, state
+}
+
+func (tts *Tests) LogLevelTest(t *testing.T) {
+	t.Run("Should require the admin scope", func(t *testing.T) {
+		response, err := http.Get(fmt.Sprintf("http://%s:%d/admin/log-level", tts.Conf.Host, tts.Conf.Metrics.Port))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Fatal("have status ", response.StatusCode, ", we want ", http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("Should return the levels of the outputs", func(t *testing.T) {
+		status, state := tts.logLevel(t, http.MethodGet, "")
+		if status != http.StatusOK {
+			t.Fatal("have status ", status, ", we want ", http.StatusOK)
+		}
+		if have, want := state[logger.OutputGraylog].Level, logger.LevelsMap[tts.Conf.Logger.Level].CapitalString(); have != want {
+			t.Fatal("have graylog level ", have, ", we want ", want)
+		}
+		if have, want := state[logger.OutputCLI].Level, logger.LevelsMap[tts.Conf.CLILevel].CapitalString(); have != want {
+			t.Fatal("have cli level ", have, ", we want ", want)
+		}
+	})
+
+	t.Run("Should override the level of a component until the TTL", func(t *testing.T) {
+		status, state := tts.logLevel(t, http.MethodPut, `{"component": "http", "level": "debug", "ttl": "300ms"}`)
+		if status != http.StatusOK {
+			t.Fatal("have status ", status, ", we want ", http.StatusOK)
+		}
+		for _, output := range []string{logger.OutputCLI, logger.OutputGraylog} {
+			c, ok := state[output].Components["http"]
+			if !ok || c.Level != "DEBUG" || c.ExpiresAt == nil {
+				t.Fatal("have override ", c, " on ", output, ", we want a temporary DEBUG")
+			}
+		}
+
+		time.Sleep(600 * time.Millisecond)
+		_, state = tts.logLevel(t, http.MethodGet, "")
+		for output, o := range state {
+			if len(o.Components) != 0 {
+				t.Fatal("the overrides of ", output, " are not reverted: ", o.Components)
+			}
+		}
+	})
+
+	t.Run("Should reject an invalid change", func(t *testing.T) {
+		for _, body := range []string{
+			`{"level": "verbose"}`,
+			`{"output": "file", "level": "DEBUG"}`,
+			`{"level": "DEBUG", "ttl": "-1m"}`,
+			`not json`,
+		} {
+			if status, _ := tts.logLevel(t, http.MethodPut, body); status != http.StatusBadRequest {
+				t.Fatal("have status ", status, " for ", body, ", we want ", http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("Should log the debug messages of the overridden component only", func(t *testing.T) {
+		l, err := NewGELFListener("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer l.Close()
+
+		levels := logger.NewLevels(logger.Level(zap.InfoLevel), logger.Level(zap.FatalLevel))
+		log, err := logger.New(l.Addr(), levels, logger.WithTransport(logger.TransportTCP))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := levels.Set(logger.OutputGraylog, "http", zapcore.DebugLevel, 0); err != nil {
+			t.Fatal(err.Error())
+		}
+		log.With(zap.String(logger.ComponentKey, "http")).Debug("http debug")
+		log.With(zap.String(logger.ComponentKey, "cache")).Debug("cache debug")
+		log.Info("info")
+		log.Sync()
+
+		// waits for a third message, which should not come
+		messages := l.wait(3, 300*time.Millisecond)
+		if len(messages) != 2 || !strings.Contains(messages[0], "http debug") || !strings.Contains(messages[1], `"info"`) {
+			t.Fatal("have messages ", messages, ", we want the debug of http and the info")
+		}
+	})
+
+	t.Run("Should revert a temporary level of an output", func(t *testing.T) {
+		levels := logger.NewLevels(logger.Level(zap.InfoLevel), logger.Level(zap.InfoLevel))
+		levels.Set(logger.OutputCLI, "", zapcore.WarnLevel, 0)
+		levels.Set(logger.OutputCLI, "", zapcore.DebugLevel, 50*time.Millisecond)
+		levels.Set(logger.OutputCLI, "", zapcore.ErrorLevel, 50*time.Millisecond)
+		if !levels.Enabled(logger.OutputCLI, "", zapcore.ErrorLevel) || levels.Enabled(logger.OutputCLI, "", zapcore.WarnLevel) {
+			t.Fatal("the temporary level is not set")
+		}
+
+		time.Sleep(150 * time.Millisecond)
+		if have := levels.State()[logger.OutputCLI].Level; have != "WARN" {
+			t.Fatal("have level ", have, ", we want the level before the temporary changes, WARN")
+		}
+	})
+}
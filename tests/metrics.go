@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func (tts *Tests) MetricsLabelsTest(t *testing.T) {
+	for _, route := range []string{"/unknown", validPath + "?limit=3"} {
+		response, err := http.Get(tts.DefaultURL + route)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+	}
+
+	response, err := http.Get(fmt.Sprintf("http://%s:%d/metrics", tts.Conf.Host, tts.Conf.Metrics.Port))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	metrics := string(body)
+
+	t.Run("Should label the requests by route template and status class", func(t *testing.T) {
+		for _, series := range []string{
+			`fizzbuzz_api_http_requests_total{app="fizz-buzz",cache="MISS",method="GET",route="/fizz-buzz",status="2xx"}`,
+			`fizzbuzz_api_http_requests_total{app="fizz-buzz",cache="NONE",method="GET",route="unmatched",status="4xx"}`,
+			`fizzbuzz_api_http_push_size_bytes_count{app="fizz-buzz",method="GET",route="/fizz-buzz",status="2xx"}`,
+			`fizzbuzz_api_http_response_size_bytes_count{app="fizz-buzz",method="GET",route="/fizz-buzz",status="2xx"}`,
+		} {
+			if !strings.Contains(metrics, series) {
+				t.Fatal("series ", series, " not found")
+			}
+		}
+	})
+
+	t.Run("Should export the most requested parameters as ranked series", func(t *testing.T) {
+		if !strings.Contains(metrics, `fizzbuzz_api_params_top_requests_total{app="fizz-buzz",params=`) ||
+			!strings.Contains(metrics, `rank="1"}`) {
+			t.Fatal("top parameters not found")
+		}
+		if n := strings.Count(metrics, "fizzbuzz_api_params_top_requests_total{"); n > tts.Conf.Metrics.ParamsTopK {
+			t.Fatal("too many top parameters series, have ", n, " and we want at most ", tts.Conf.Metrics.ParamsTopK)
+		}
+	})
+
+	t.Run("Should export the cache stats", func(t *testing.T) {
+		for _, event := range []string{"requests", "hits", "new_fetches", "stale_fetches", "early_fetches", "warm_fetches",
+			"backend_hits", "backend_errors", "peer_hits", "peer_errors"} {
+			series := `fizzbuzz_api_xcache_events_total{app="fizz-buzz",event="` + event + `"}`
+			if !strings.Contains(metrics, series) {
+				t.Fatal("series ", series, " not found")
+			}
+		}
+		if strings.Contains(metrics, `fizzbuzz_api_xcache_events_total{app="fizz-buzz",event="requests"} 0`) {
+			t.Fatal("cache requests not counted")
+		}
+	})
+
+	t.Run("Should not label the JWT clients by subject", func(t *testing.T) {
+		series := `fizzbuzz_api_auth_requests_total{app="fizz-buzz",key_id="jwt",result="ok",tier="pro"}`
+		if !strings.Contains(metrics, series) {
+			t.Fatal("series ", series, " not found")
+		}
+		if strings.Contains(metrics, `key_id="jwt:`) {
+			t.Fatal("JWT clients labelled by subject")
+		}
+	})
+}
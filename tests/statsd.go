@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ariden83/fizz-buzz/internal/metrics"
+)
+
+// StatsDListener is a local UDP listener standing in for a StatsD agent.
+type StatsDListener struct {
+	conn    net.PacketConn
+	lock    sync.Mutex
+	packets []string
+}
+
+// NewStatsDListener starts a listener, to set as Metrics.StatsDAddr.
+func NewStatsDListener() (*StatsDListener, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &StatsDListener{conn: conn}
+	go l.receive()
+	return l, nil
+}
+
+// Addr returns the address of the listener.
+func (l *StatsDListener) Addr() string {
+	return l.conn.LocalAddr().String()
+}
+
+func (l *StatsDListener) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		l.lock.Lock()
+		l.packets = append(l.packets, string(buf[:n]))
+		l.lock.Unlock()
+	}
+}
+
+// Packets returns the packets received.
+func (l *StatsDListener) Packets() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string{}, l.packets...)
+}
+
+// lines returns the lines received, waiting until one starts with prefix.
+func (l *StatsDListener) lines(prefix string, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		var lines []string
+		found := false
+		for _, p := range l.Packets() {
+			for _, line := range strings.Split(p, "\n") {
+				lines = append(lines, line)
+				found = found || strings.HasPrefix(line, prefix)
+			}
+		}
+		if found || time.Now().After(deadline) {
+			return lines
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (tts *Tests) StatsDTest(t *testing.T) {
+	if tts.StatsD == nil {
+		t.Skip("statsd is disabled")
+	}
+
+	t.Run("Should mirror the request counters, durations and cache stats", func(t *testing.T) {
+		response, err := http.Get(tts.DefaultURL + validPath + "?limit=41&strOne=statsd")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		response.Body.Close()
+
+		prefix := "fizzbuzz_api.http.requests:1|c|#"
+		tags := "method:GET,route:/fizz-buzz,status:2xx,cache:MISS"
+		lines := tts.StatsD.lines(prefix+tags, 5*time.Second)
+		for _, want := range []string{
+			prefix + tags,
+			"fizzbuzz_api.http.request.duration:",
+			"fizzbuzz_api.http.response.size:",
+			"fizzbuzz_api.cache.requests:1|c|#status:MISS",
+			"fizzbuzz_api.xcache.requests:",
+			"fizzbuzz_api.xcache.new_fetches:",
+		} {
+			found := false
+			for _, line := range lines {
+				found = found || strings.HasPrefix(line, want)
+			}
+			if !found {
+				t.Fatal("line ", want, " not received")
+			}
+		}
+	})
+
+	t.Run("Should batch the lines into packets of the max size", func(t *testing.T) {
+		batched := false
+		for _, p := range tts.StatsD.Packets() {
+			if len(p) > tts.Conf.Metrics.StatsDMaxPacketSize {
+				t.Fatal("packet of ", len(p), " bytes, over the max size")
+			}
+			batched = batched || strings.Contains(p, "\n")
+		}
+		if !batched {
+			t.Fatal("every packet holds a single line")
+		}
+	})
+
+	t.Run("Should sample the counters without tags for StatsD", func(t *testing.T) {
+		l, err := NewStatsDListener()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer l.conn.Close()
+
+		s, err := metrics.NewStatsD(l.Addr(), metrics.WithFlavor(metrics.FlavorStatsD), metrics.WithSampleRate(0.5))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for i := 0; i < 400; i++ {
+			s.Count("sampled", 1, "tag:value")
+		}
+		s.Close()
+		if err := s.Close(); err != nil {
+			t.Fatal("second close failed: ", err.Error())
+		}
+
+		lines := l.lines("sampled", 2*time.Second)
+		if len(lines) < 100 || len(lines) > 300 {
+			t.Fatal("have ", len(lines), " lines, we want about 200")
+		}
+		for _, line := range lines {
+			if line != "sampled:1|c|@0.5" {
+				t.Fatal("Bad line '", line, "'")
+			}
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	traceIDForTests  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentIDForTests = "00f067aa0ba902b7"
+)
+
+// collectedSpan is the part of an OTLP span checked by the tests.
+type collectedSpan struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Attributes   map[string]string
+	Resource     map[string]string // attributes of the resource of the span
+}
+
+func (s collectedSpan) attribute(key string) (string, bool) {
+	v, ok := s.Attributes[key]
+	return v, ok
+}
+
+// attributes formats the values of OTLP attributes.
+func attributes(kvs []*commonv1.KeyValue) map[string]string {
+	attrs := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		switch v := kv.GetValue().GetValue().(type) {
+		case *commonv1.AnyValue_StringValue:
+			attrs[kv.GetKey()] = v.StringValue
+		case *commonv1.AnyValue_BoolValue:
+			attrs[kv.GetKey()] = fmt.Sprint(v.BoolValue)
+		case *commonv1.AnyValue_IntValue:
+			attrs[kv.GetKey()] = fmt.Sprint(v.IntValue)
+		}
+	}
+	return attrs
+}
+
+// Collector is a local OTLP/HTTP collector receiving the spans exported by the API, protobuf encoded.
+type Collector struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	spans  []collectedSpan
+}
+
+// NewCollector starts a collector, to set as Tracing.Endpoint.
+func NewCollector() *Collector {
+	c := &Collector{}
+	c.server = httptest.NewServer(http.HandlerFunc(c.receive))
+	return c
+}
+
+// URL returns the URL of the traces of the collector.
+func (c *Collector) URL() string {
+	return c.server.URL + "/v1/traces"
+}
+
+func (c *Collector) receive(w http.ResponseWriter, r *http.Request) {
+	req := &collectortrace.ExportTraceServiceRequest{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.lock.Lock()
+	for _, rs := range req.GetResourceSpans() {
+		resource := attributes(rs.GetResource().GetAttributes())
+		for _, ils := range rs.GetInstrumentationLibrarySpans() {
+			for _, s := range ils.GetSpans() {
+				c.spans = append(c.spans, collectedSpan{
+					TraceID:      hex.EncodeToString(s.GetTraceId()),
+					SpanID:       hex.EncodeToString(s.GetSpanId()),
+					ParentSpanID: hex.EncodeToString(s.GetParentSpanId()),
+					Name:         s.GetName(),
+					Kind:         int(s.GetKind()),
+					Attributes:   attributes(s.GetAttributes()),
+					Resource:     resource,
+				})
+			}
+		}
+	}
+	c.lock.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// trace waits for the spans of a trace, until the server span is received.
+func (c *Collector) trace(traceID string, timeout time.Duration) []collectedSpan {
+	deadline := time.Now().Add(timeout)
+	for {
+		var spans []collectedSpan
+		server := false
+		c.lock.Lock()
+		for _, s := range c.spans {
+			if s.TraceID == traceID {
+				spans = append(spans, s)
+				server = server || s.ParentSpanID == parentIDForTests
+			}
+		}
+		c.lock.Unlock()
+		if server || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (tts *Tests) TracingTest(t *testing.T) {
+	if tts.Collector == nil {
+		t.Skip("tracing is disabled")
+	}
+
+	r, err := http.NewRequest(http.MethodGet, tts.DefaultURL+validPath+"?limit=37&strOne=trace&strTwo=span", nil)
+	if err != nil {
+		t.Fatal("fail to build request ", err.Error())
+	}
+	r.Header.Set("traceparent", "00-"+traceIDForTests+"-"+parentIDForTests+"-01")
+	r.Header.Set("tracestate", "vendor=value")
+
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("wrong http status returned ", response.StatusCode)
+	}
+
+	t.Run("Should return the traceresponse header", func(t *testing.T) {
+		parts := strings.Split(response.Header.Get("traceresponse"), "-")
+		if len(parts) != 4 || parts[1] != traceIDForTests || parts[2] == parentIDForTests || parts[3] != "01" {
+			t.Fatal("Bad traceresponse header '", response.Header.Get("traceresponse"), "'")
+		}
+	})
+
+	spans := tts.Collector.trace(traceIDForTests, 5*time.Second)
+	byName := map[string]collectedSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+
+	t.Run("Should export the server span as a child of the caller", func(t *testing.T) {
+		server, ok := byName["GET /fizz-buzz"]
+		if !ok {
+			t.Fatal("server span not exported, have ", len(spans), " spans")
+		}
+		if server.ParentSpanID != parentIDForTests {
+			t.Fatal("Bad parent of the server span, have '", server.ParentSpanID, "'")
+		}
+		if server.Kind != 2 {
+			t.Fatal("Bad kind of the server span, have ", server.Kind)
+		}
+		if route, _ := server.attribute("http.route"); route != validPath {
+			t.Fatal("Bad http.route attribute, have '", route, "'")
+		}
+		if service := server.Resource["service.name"]; service != tts.Conf.Name {
+			t.Fatal("Bad service.name resource attribute, have '", service, "'")
+		}
+	})
+
+	t.Run("Should export the child spans of the request", func(t *testing.T) {
+		server := byName["GET /fizz-buzz"]
+		for _, name := range []string{"validate", "xcache.Fetch", "render"} {
+			s, ok := byName[name]
+			if !ok {
+				t.Fatal("span ", name, " not exported")
+			}
+			if s.ParentSpanID != server.SpanID {
+				t.Fatal("span ", name, " isn't a child of the server span")
+			}
+		}
+		fetch := byName["xcache.Fetch"]
+		if hit, _ := fetch.attribute("cache.hit"); hit != "false" {
+			t.Fatal("Bad cache.hit attribute, have '", hit, "'")
+		}
+		if generate, ok := byName["generate"]; !ok || generate.ParentSpanID != fetch.SpanID {
+			t.Fatal("span generate isn't a child of the xcache.Fetch span")
+		}
+	})
+
+	t.Run("Should link the response duration to the trace", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%d/metrics", tts.Conf.Host, tts.Conf.Metrics.Port), nil)
+		r.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		if !strings.Contains(string(body), `trace_id="`+traceIDForTests+`"`) {
+			t.Fatal("exemplar of the trace not found in the metrics")
+		}
+	})
+}
@@ -15,6 +15,8 @@ import (
 type Tests struct {
 	Conf       *config.Config
 	DefaultURL string
+	Collector  *Collector      // spans exported by the API, nil if tracing is disabled
+	StatsD     *StatsDListener // metrics mirrored by the API, nil if statsd is disabled
 }
 
 type test func(t *testing.T, args ...interface{})